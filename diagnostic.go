@@ -0,0 +1,30 @@
+package fountain
+
+import (
+	"fmt"
+)
+
+type Severity int
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Diagnostic is a problem found in a script, at the place it was found.
+type Diagnostic struct {
+	Severity Severity
+	Message string
+	Position Position
+}
+
+func (d Diagnostic) Error() string {
+	return fmt.Sprintf("%d:%d: %s: %s", d.Position.Line, d.Position.Column, d.Severity, d.Message)
+}
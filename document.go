@@ -3,22 +3,131 @@ package fountain
 type Chunk struct {
 	Content string
 	Styles []string
+	Span Span
+}
+
+func (c *Chunk) isNote() bool {
+	for _, style := range c.Styles {
+		if style == "comment" {
+			return true
+		}
+	}
+	return false
 }
 
 type Line struct {
 	Chunks []Chunk
 	Type string
+	Span Span
 }
 
 type Paragraph struct {
 	Lines []Line
 	Type string
+	Scene *Scene
+	Depth int
+	Columns []Paragraph
+	Span Span
+}
+
+// Position is a place in the source of a script. Offset counts bytes from
+// the start; Line and Column count from one, with Column in bytes.
+type Position struct {
+	Offset, Line, Column int
+}
+
+// Span is the stretch of source an element came from, ending just before
+// End. A line with nothing on it has an empty Span. Lines and paragraphs
+// span their content, from their first chunk to their last, so the markup
+// around it is left out: the hashes of a section, the marks that force an
+// element, such as the dot of a heading or the @ of a cue, and a scene
+// number.
+type Span struct {
+	Start, End Position
+}
+
+// Scene holds the parts of a scene heading. Establishing shots set neither
+// Interior nor Exterior, and forced headings may have only a Location.
+type Scene struct {
+	Interior, Exterior bool
+	Location, TimeOfDay string
+	Number string
+}
+
+func (p *Paragraph) IsSceneHeading() bool {
+	return p.Type == "scene-heading"
+}
+
+func (p *Paragraph) IsTransition() bool {
+	return p.Type == "transition"
+}
+
+func (p *Paragraph) IsCentered() bool {
+	return p.Type == "centered"
+}
+
+func (p *Paragraph) IsPageBreak() bool {
+	return p.Type == "page-break"
 }
 
+func (p *Paragraph) IsSection() bool {
+	return p.Type == "section"
+}
+
+func (p *Paragraph) IsSynopsis() bool {
+	return p.Type == "synopsis"
+}
+
+func (p *Paragraph) IsLyric() bool {
+	return p.Type == "lyric"
+}
+
+// Text joins the content of every chunk in the paragraph.
+func (p *Paragraph) Text() string {
+	text := ""
+	for i, line := range p.Lines {
+		if i > 0 {
+			text += "\n"
+		}
+		for _, chunk := range line.Chunks {
+			text += chunk.Content
+		}
+	}
+	return text
+}
+
+// plainText is like Text, but leaves out notes.
+func (p *Paragraph) plainText() string {
+	text := ""
+	for i, line := range p.Lines {
+		if i > 0 {
+			text += "\n"
+		}
+		for _, chunk := range line.Chunks {
+			if !chunk.isNote() {
+				text += chunk.Content
+			}
+		}
+	}
+	return text
+}
+
+// IsDialogue reports whether the paragraph is a single block of dialogue.
+// It is false for dual dialogue, whose Columns are each dialogue; Speaker,
+// Extensions and Dialogue likewise return nothing for dual dialogue and
+// must be asked of its columns.
 func (p *Paragraph) IsDialogue() bool {
 	return p.Type == "dialogue"
 }
 
+// IsDualDialogue reports whether the paragraph sets two dialogue paragraphs
+// side by side. They are its Columns, left then right.
+func (p *Paragraph) IsDualDialogue() bool {
+	return p.Type == "dual-dialogue"
+}
+
+// Speaker is the name on the dialogue's cue, or "" if the paragraph is not
+// dialogue.
 func (p *Paragraph) Speaker() string {
 	if p.IsDialogue() {
 		return p.Lines[0].Chunks[0].Content
@@ -26,13 +135,27 @@ func (p *Paragraph) Speaker() string {
 	return ""
 }
 
+// Extensions lists the extensions on the speaker's cue, such as "V.O." or
+// "CONT'D", which Speaker leaves out.
+func (p *Paragraph) Extensions() []string {
+	extensions := []string{}
+	if p.IsDialogue() {
+		for _, chunk := range p.Lines[0].Chunks[1:] {
+			extensions = append(extensions, chunk.Content)
+		}
+	}
+	return extensions
+}
+
+// Dialogue joins the spoken and sung lines of dialogue, leaving out
+// parentheticals and notes.
 func (p *Paragraph) Dialogue() string {
 	if p.IsDialogue() {
 		dialogue := ""
 		for _, line := range p.Lines {
-			if line.Type == "dialogue" {
+			if line.Type == "dialogue" || line.Type == "lyric" {
 				for _, chunk := range line.Chunks {
-					if !(len(chunk.Styles) == 1 && chunk.Styles[0] == "comment") {
+					if !chunk.isNote() {
 						dialogue += " " + chunk.Content
 					}
 				}
@@ -43,8 +166,98 @@ func (p *Paragraph) Dialogue() string {
 	return ""
 }
 
+// Document is a parsed script. Title, Credit, Author, DraftDate and Data
+// hold the last value given for each title page key; TitlePage keeps every
+// entry in the order written.
 type Document struct {
 	Title, Credit, Author, DraftDate string
 	Data map[string]string
+	TitlePage []TitlePageEntry
 	Body []Paragraph
+	boneyard []Boneyard
+	notes []Note
+}
+
+// TitlePageEntry is a key and value from the title page. A value written
+// over several indented lines has its lines joined with newlines.
+type TitlePageEntry struct {
+	Key, Value string
+}
+
+// Values lists every value given for key on the title page, in order.
+func (d *Document) Values(key string) []string {
+	values := []string{}
+	for _, entry := range d.TitlePage {
+		if entry.Key == key {
+			values = append(values, entry.Value)
+		}
+	}
+	return values
+}
+
+// Note is a note left in the script with [[ ]]. Paragraph and Line index
+// the line in Body it is anchored to; in dual dialogue, Column says which
+// side the line is in.
+type Note struct {
+	Content string
+	Paragraph, Column, Line int
+}
+
+// Notes lists the notes in the script, in order.
+func (d *Document) Notes() []Note {
+	return d.notes
+}
+
+// Boneyard is material cut from the script with /* */. Paragraph is the
+// index in Body of the paragraph it was cut from or, if it stood on its own,
+// of the paragraph that follows it.
+type Boneyard struct {
+	Content string
+	Paragraph int
+}
+
+// Boneyard lists the material cut from the script, in order.
+func (d *Document) Boneyard() []Boneyard {
+	return d.boneyard
+}
+
+// Section is a node in a document's outline. Scenes point into the
+// document's Body.
+type Section struct {
+	Title string
+	Depth int
+	Synopses []string
+	Scenes []*Paragraph
+	Sections []*Section
+}
+
+// Outline nests the document's sections by depth under a root section of
+// depth zero. Synopses and scenes belong to the section they follow.
+func (d *Document) Outline() *Section {
+	root := &Section{Title: d.Title}
+	open := []*Section{root}
+
+	for i := range d.Body {
+		paragraph := &d.Body[i]
+		current := open[len(open)-1]
+
+		if paragraph.IsSection() {
+			for len(open) > 1 && open[len(open)-1].Depth >= paragraph.Depth {
+				open = open[:len(open)-1]
+			}
+			section := &Section{Title: paragraph.plainText(), Depth: paragraph.Depth}
+			parent := open[len(open)-1]
+			parent.Sections = append(parent.Sections, section)
+			open = append(open, section)
+		}
+
+		if paragraph.IsSynopsis() {
+			current.Synopses = append(current.Synopses, paragraph.plainText())
+		}
+
+		if paragraph.IsSceneHeading() {
+			current.Scenes = append(current.Scenes, paragraph)
+		}
+	}
+	return root
 }
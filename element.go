@@ -0,0 +1,158 @@
+package fountain
+
+import (
+	"strings"
+)
+
+// ElementType is the kind of a Paragraph or Line, the typed form of its Type
+// string.
+type ElementType int
+
+const (
+	ElementUnknown ElementType = iota
+	ElementAction
+	ElementSceneHeading
+	ElementTransition
+	ElementCentered
+	ElementPageBreak
+	ElementSection
+	ElementSynopsis
+	ElementLyric
+	ElementDialogue
+	ElementDualDialogue
+	ElementSpeaker
+	ElementParenthetical
+)
+
+var elementNames = []string{
+	ElementUnknown: "",
+	ElementAction: "action",
+	ElementSceneHeading: "scene-heading",
+	ElementTransition: "transition",
+	ElementCentered: "centered",
+	ElementPageBreak: "page-break",
+	ElementSection: "section",
+	ElementSynopsis: "synopsis",
+	ElementLyric: "lyric",
+	ElementDialogue: "dialogue",
+	ElementDualDialogue: "dual-dialogue",
+	ElementSpeaker: "speaker",
+	ElementParenthetical: "parenthetical",
+}
+
+// String returns the name used for t in Type fields.
+func (t ElementType) String() string {
+	if t < 0 || int(t) >= len(elementNames) {
+		return ""
+	}
+	return elementNames[t]
+}
+
+// ParseElementType returns the element type named name, or ElementUnknown.
+func ParseElementType(name string) ElementType {
+	for i, n := range elementNames {
+		if n == name {
+			return ElementType(i)
+		}
+	}
+	return ElementUnknown
+}
+
+// Style is a set of inline styles, the typed form of a Chunk's Styles.
+type Style int
+
+const (
+	StyleBold Style = 1 << iota
+	StyleItalic
+	StyleUnderline
+	StyleNote
+	StyleExtension
+	StyleIndent
+)
+
+var styleNames = map[string]Style{
+	"bold": StyleBold,
+	"italic": StyleItalic,
+	"underline": StyleUnderline,
+	"comment": StyleNote,
+	"extension": StyleExtension,
+}
+
+// Has reports whether s includes every style in style.
+func (s Style) Has(style Style) bool {
+	return s&style == style
+}
+
+// Node is any part of a parsed document: a *Paragraph or *Line, which are
+// Blocks, or a *Chunk, which is Inline.
+type Node interface {
+	node()
+}
+
+// Block is a node laid out on lines of its own. The children of a Paragraph
+// are its lines, or for dual dialogue its columns; the children of a Line
+// are its chunks.
+type Block interface {
+	Node
+	Element() ElementType
+	Children() []Node
+}
+
+// Inline is a run of text within a line.
+type Inline interface {
+	Node
+	Style() Style
+	Text() string
+}
+
+func (p *Paragraph) node() {}
+func (l *Line) node() {}
+func (c *Chunk) node() {}
+
+func (p *Paragraph) Element() ElementType {
+	return ParseElementType(p.Type)
+}
+
+func (p *Paragraph) Children() []Node {
+	children := []Node{}
+	if p.IsDualDialogue() {
+		for i := range p.Columns {
+			children = append(children, &p.Columns[i])
+		}
+		return children
+	}
+	for i := range p.Lines {
+		children = append(children, &p.Lines[i])
+	}
+	return children
+}
+
+func (l *Line) Element() ElementType {
+	return ParseElementType(l.Type)
+}
+
+func (l *Line) Children() []Node {
+	children := []Node{}
+	for i := range l.Chunks {
+		children = append(children, &l.Chunks[i])
+	}
+	return children
+}
+
+// Style combines the chunk's Styles. An indent-N style sets StyleIndent, and
+// the indent's width is the length of the chunk's Content.
+func (c *Chunk) Style() Style {
+	var style Style
+	for _, name := range c.Styles {
+		if strings.HasPrefix(name, "indent-") {
+			style |= StyleIndent
+			continue
+		}
+		style |= styleNames[name]
+	}
+	return style
+}
+
+func (c *Chunk) Text() string {
+	return c.Content
+}
@@ -1,7 +1,10 @@
 package fountain
 
 import (
+	"context"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/exupero/state-lexer"
 )
@@ -17,15 +20,42 @@ const (
 	TokenUnderscore
 	TokenIndent
 
+	TokenSceneHeading
+	TokenSceneNumber
+	TokenTransition
+	TokenCentered
+	TokenCenteredClose
+	TokenPageBreak
+	TokenSection
+	TokenSynopsis
+	TokenLyric
+
 	TokenSpeaker
 	TokenDialogue
 	TokenParenthetical
 
 	TokenCommentOpen
 	TokenCommentClose
+
+	TokenBoneyard
+
+	// TokenUnclosed follows boneyard or a note that runs to the end of the
+	// script without being closed.
+	TokenUnclosed
 )
 
+// tokenSkip marks text the lexer passes over, such as markup and the
+// newlines that end lines, so that the parser can tell where in the source
+// each token starts. Tokenize filters it out.
+const tokenSkip lexer.TokenType = -1
+
+// skip passes over the text lexed since the last token.
+func skip(lex *lexer.Lexer) {
+	lex.Emit(tokenSkip)
+}
+
 func lexDataValue(lex *lexer.Lexer) lexer.StateFn {
+	empty := true
 	for {
 		r := lex.NextRune()
 		if r == lexer.Eof {
@@ -35,14 +65,28 @@ func lexDataValue(lex *lexer.Lexer) lexer.StateFn {
 			lex.Backup()
 			break
 		}
+		empty = false
+	}
+	// A key with nothing after it takes its value from the indented lines
+	// that follow.
+	if empty {
+		skip(lex)
+	} else {
+		lex.Emit(TokenDataValue)
 	}
-	lex.Emit(TokenDataValue)
 
 	lex.Accept("\n")
-	lex.Ignore()
+	skip(lex)
 	return lexDataBlock
 }
 
+// An indented line in the data block continues the value of the key above.
+func lexDataContinuation(lex *lexer.Lexer) lexer.StateFn {
+	lex.AcceptRun(" \t")
+	skip(lex)
+	return lexDataValue
+}
+
 func lexDataKey(lex *lexer.Lexer) lexer.StateFn {
 	for {
 		r := lex.NextRune()
@@ -57,7 +101,7 @@ func lexDataKey(lex *lexer.Lexer) lexer.StateFn {
 	lex.Emit(TokenDataKey)
 
 	lex.AcceptRun(": ")
-	lex.Ignore()
+	skip(lex)
 	return lexDataValue
 }
 
@@ -68,15 +112,79 @@ func lexDataBlock(lex *lexer.Lexer) lexer.StateFn {
 		return nil
 	}
 
+	// The newline ending the last key's line has been passed over, so the
+	// break before the body is what follows it.
 	if r == '\n' {
-		lex.Backup()
+		lex.AcceptRun("\n")
+		lex.Emit(TokenParagraph)
 		return lexBody
 	}
 
+	if r == ' ' || r == '\t' {
+		return lexDataContinuation
+	}
+
 	return lexDataKey
 }
 
 func lexBody(lex *lexer.Lexer) lexer.StateFn {
+	if lex.Peek() == lexer.Eof {
+		return nil
+	}
+
+	if lex.Peek() == ' ' {
+		return lexIndent
+	}
+
+	if lex.Peek() == '\n' {
+		return lexParagraph
+	}
+
+	if lex.Peek() == '.' {
+		return lexForcedSceneHeading
+	}
+
+	if lex.Peek() == '>' {
+		return lexForcedTransition
+	}
+
+	if lex.Peek() == '=' {
+		return lexPageBreak
+	}
+
+	if lex.Peek() == '#' {
+		return lexSection
+	}
+
+	if lex.Peek() == '/' {
+		return lexBoneyard
+	}
+
+	if lex.Peek() == '!' {
+		return lexForcedAction
+	}
+
+	if lex.Peek() == '@' {
+		return lexForcedSpeaker
+	}
+
+	if lex.Peek() == '~' {
+		return lexLyric
+	}
+
+	if lex.Peek() == '\\' {
+		return lexText
+	}
+
+	prefix := acceptPrefix(lex, sceneHeadingPrefixes)
+	if isSceneHeading(prefix) {
+		return lexSceneHeading
+	}
+	return lexLineContent(lex, prefix, true)
+}
+
+// lexLine lexes a line that continues a paragraph rather than opening one.
+func lexLine(lex *lexer.Lexer) lexer.StateFn {
 	if lex.Peek() == ' ' {
 		return lexIndent
 	}
@@ -85,39 +193,476 @@ func lexBody(lex *lexer.Lexer) lexer.StateFn {
 		return lexParagraph
 	}
 
+	if lex.Peek() == '>' {
+		return lexForcedTransition
+	}
+
+	if lex.Peek() == '!' {
+		return lexForcedAction
+	}
+
+	if lex.Peek() == '~' {
+		return lexLyric
+	}
+
+	if lex.Peek() == '=' {
+		return lexEquals(lex, false)
+	}
+
+	return lexLineContent(lex, "", false)
+}
+
+// A leading ~ marks a line of lyrics, which may be styled like action.
+func lexLyric(lex *lexer.Lexer) lexer.StateFn {
+	lex.Accept("~")
+	lex.Emit(TokenLyric)
+	return lexText
+}
+
+// A leading ! forces a line to be action, whatever its case.
+func lexForcedAction(lex *lexer.Lexer) lexer.StateFn {
+	lex.Accept("!")
+	skip(lex)
+	return lexText
+}
+
+// A leading @ forces a line to be a speaker, whatever its case.
+func lexForcedSpeaker(lex *lexer.Lexer) lexer.StateFn {
+	lex.Accept("@")
+	skip(lex)
+	lex.Until("\n")
+	return lexSpeaker
+}
+
+// lexLineContent decides what the rest of a line is, given what has already
+// been consumed of it. Transitions and cues must open a paragraph.
+func lexLineContent(lex *lexer.Lexer, line string, opensParagraph bool) lexer.StateFn {
+	if strings.IndexFunc(line, unicode.IsLower) >= 0 {
+		return lexText
+	}
+
 	for {
 		r := lex.NextRune()
 		if r == lexer.Eof {
+			if opensParagraph && isTransition(line) {
+				lex.Emit(TokenTransition)
+			} else {
+				lex.Emit(TokenText)
+			}
 			break
 		}
-		if strings.IndexRune("abcdefghijklmnopqrstuvwxyz*_()[]", r) >= 0 {
+		if r == '(' && strings.TrimSpace(line) != "" {
+			extensions, ok := acceptExtensions(lex)
+			if !ok {
+				return lexText
+			}
+			line += "(" + extensions
+			continue
+		}
+		if unicode.IsLower(r) || strings.IndexRune("*_()[]", r) >= 0 {
+			lex.Backup()
+			return lexText
+		}
+		if r == '/' && lex.Peek() == '*' {
+			lex.Backup()
+			return lexText
+		}
+		if r == '\\' {
 			lex.Backup()
 			return lexText
 		}
 		if r == '\n' {
 			lex.Backup()
+			if !opensParagraph {
+				lex.Emit(TokenText)
+				return lexParagraph
+			}
+			// Transitions stand alone, while cues are followed right away
+			// by dialogue. Anything else in capitals is action.
+			if !isTransition(line) && !isCue(line) {
+				lex.Emit(TokenText)
+				return lexParagraph
+			}
+			blank := nextLineBlank(lex)
+			if isTransition(line) && blank {
+				lex.Emit(TokenTransition)
+				return lexParagraph
+			}
+			if !isCue(line) || blank {
+				lex.Emit(TokenText)
+				return lexParagraph
+			}
 			return lexSpeaker
 		}
+		line += string(r)
 	}
 	return nil
 }
 
+// acceptExtensions consumes the rest of a character's extensions, such as
+// "(V.O.) (CONT'D)", which may be in any case, and an optional caret after
+// them. It reports false if the line goes on to anything else.
+func acceptExtensions(lex *lexer.Lexer) (string, bool) {
+	consumed := ""
+	for {
+		r := lex.NextRune()
+		if r == lexer.Eof {
+			return consumed, false
+		}
+		if r == '\n' {
+			lex.Backup()
+			return consumed, false
+		}
+		consumed += string(r)
+		if r != ')' {
+			continue
+		}
+
+		for lex.Accept(" ") {
+			consumed += " "
+		}
+		if lex.Accept("(") {
+			consumed += "("
+			continue
+		}
+		if lex.Accept("^") {
+			consumed += "^"
+			for lex.Accept(" ") {
+				consumed += " "
+			}
+		}
+		r = lex.Peek()
+		return consumed, r == '\n' || r == lexer.Eof
+	}
+}
+
+// nextLineBlank reports whether the line after the current one is blank or
+// missing. The lexer must sit on the newline that ends the line, and is left
+// there.
+func nextLineBlank(lex *lexer.Lexer) bool {
+	lex.Accept("\n")
+	r := lex.Peek()
+	blank := r == '\n' || r == lexer.Eof
+	lex.Backup()
+	if r < utf8.RuneSelf {
+		return blank
+	}
+
+	// Peek leaves the width of r behind, so backing up lands as much as
+	// three bytes before the newline, and past any newline in those bytes.
+	// Walk forward to each newline in turn until the one followed by r.
+	newlines := 0
+	for {
+		for lex.Peek() != '\n' {
+			lex.NextRune()
+		}
+		lex.NextRune()
+		if lex.Peek() == r {
+			break
+		}
+		newlines++
+	}
+	// That leaves the lexer past the newline again, so back up and walk to
+	// it knowing how many newlines come first.
+	lex.Backup()
+	for ; newlines > 0; newlines-- {
+		for lex.NextRune() != '\n' {
+		}
+	}
+	for lex.Peek() != '\n' {
+		lex.NextRune()
+	}
+	return blank
+}
+
+// isCue reports whether line, which has no lowercase letters, could be a
+// character's cue. The name must have at least one uppercase letter, so
+// numbers, punctuation and scripts without case are not mistaken for one.
+func isCue(line string) bool {
+	name := line
+	if i := strings.Index(line, "("); i >= 0 {
+		name = line[:i]
+	}
+	return strings.IndexFunc(name, unicode.IsUpper) >= 0
+}
+
+func isTransition(line string) bool {
+	return strings.HasSuffix(strings.TrimSpace(line), "TO:")
+}
+
+// Three or more equals signs alone on a line force a page break.
+func lexPageBreak(lex *lexer.Lexer) lexer.StateFn {
+	return lexEquals(lex, true)
+}
+
+// lexEquals lexes a line that starts with an equals sign: a page break
+// wherever it is, or else a synopsis if it opens a paragraph.
+func lexEquals(lex *lexer.Lexer, opensParagraph bool) lexer.StateFn {
+	line := ""
+	for lex.Accept("=") {
+		line += "="
+	}
+	equals := len(line)
+	for lex.Accept(" ") {
+		line += " "
+	}
+
+	r := lex.Peek()
+	if equals >= 3 && (r == '\n' || r == lexer.Eof) {
+		lex.Emit(TokenPageBreak)
+		if r == lexer.Eof {
+			return nil
+		}
+		return lexParagraph
+	}
+	if opensParagraph && equals == 1 && r != '\n' && r != lexer.Eof {
+		skip(lex)
+		return lexSynopsis
+	}
+	return lexLineContent(lex, line, opensParagraph)
+}
+
+func lexSynopsis(lex *lexer.Lexer) lexer.StateFn {
+	return lexNotedLine(lex, TokenSynopsis)
+}
+
+// Sections are marked with one or more hashes, one for each level of depth.
+func lexSection(lex *lexer.Lexer) lexer.StateFn {
+	lex.AcceptRun("#")
+	lex.Emit(TokenSection)
+
+	lex.AcceptRun(" ")
+	skip(lex)
+
+	return lexNotedLine(lex, TokenText)
+}
+
+// lexNotedLine emits the rest of a line as text of type text, apart from
+// any notes and escapes in it.
+func lexNotedLine(lex *lexer.Lexer, text lexer.TokenType) lexer.StateFn {
+	for {
+		r := lex.NextRune()
+		if r == lexer.Eof {
+			lex.Emit(text)
+			return nil
+		}
+		if r == '\n' {
+			lex.Backup()
+			lex.Emit(text)
+			return lexParagraph
+		}
+		if !lexEscape(lex, r, text) {
+			lexNote(lex, r, text)
+		}
+	}
+}
+
+// A leading > forces a transition, unless the line turns out to be centered
+// text closed with a <.
+func lexForcedTransition(lex *lexer.Lexer) lexer.StateFn {
+	lex.Accept(">")
+	lex.AcceptRun(" ")
+	skip(lex)
+
+	for {
+		r := lex.NextRune()
+		if r == lexer.Eof {
+			lex.Emit(TokenTransition)
+			return nil
+		}
+		if r == '\n' {
+			lex.Backup()
+			lex.Emit(TokenTransition)
+			return lexParagraph
+		}
+		// The line may yet end with <, so markup is read as centered
+		// text, and the parser makes it a transition if it does not.
+		if strings.IndexRune("<*_[/\\", r) >= 0 {
+			lex.Backup()
+			return lexCentered
+		}
+	}
+}
+
+func lexCentered(lex *lexer.Lexer) lexer.StateFn {
+	for {
+		r := lex.NextRune()
+
+		if r == lexer.Eof {
+			lex.Emit(TokenCentered)
+			return nil
+		}
+
+		if r == '\n' {
+			lex.Backup()
+			lex.Emit(TokenCentered)
+			return lexParagraph
+		}
+
+		if r == '<' {
+			lex.Backup()
+			lex.Emit(TokenCentered)
+			lex.Accept("<")
+
+			// Only a < at the end of the line closes centered text.
+			r = lex.Peek()
+			if r == lexer.Eof {
+				lex.Emit(TokenCenteredClose)
+				return nil
+			}
+			if r == '\n' {
+				lex.Emit(TokenCenteredClose)
+				return lexParagraph
+			}
+			return lexCentered
+		}
+
+		if lexMarker(lex, r, TokenCentered) {
+			return lexCentered
+		}
+	}
+}
+
+// Scene headings begin with one of these, in any case, followed by a dot or
+// a space.
+var sceneHeadingPrefixes = []string{"INT", "EXT", "EST", "INT./EXT", "INT/EXT", "I/E"}
+
+func isSceneHeading(prefix string) bool {
+	for _, p := range sceneHeadingPrefixes {
+		if strings.EqualFold(prefix, p+".") || strings.EqualFold(prefix, p+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptPrefix consumes runes for as long as they could still begin one of
+// prefixes followed by a dot or a space, and returns what it consumed.
+func acceptPrefix(lex *lexer.Lexer, prefixes []string) string {
+	consumed := ""
+	for {
+		r := lex.NextRune()
+		if r == lexer.Eof {
+			return consumed
+		}
+		candidate := strings.ToUpper(consumed + string(r))
+		matches := false
+		for _, p := range prefixes {
+			if strings.HasPrefix(p+".", candidate) || strings.HasPrefix(p+" ", candidate) {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			lex.Backup()
+			return consumed
+		}
+		consumed += string(r)
+		if isSceneHeading(consumed) {
+			return consumed
+		}
+	}
+}
+
+// A leading dot forces a scene heading, unless it starts an ellipsis.
+func lexForcedSceneHeading(lex *lexer.Lexer) lexer.StateFn {
+	lex.Accept(".")
+	r := lex.Peek()
+	if unicode.IsLetter(r) || unicode.IsDigit(r) {
+		skip(lex)
+		return lexSceneHeading
+	}
+	return lexText
+}
+
+func lexSceneHeading(lex *lexer.Lexer) lexer.StateFn {
+	for {
+		r := lex.NextRune()
+		if r == lexer.Eof {
+			lex.Emit(TokenSceneHeading)
+			return nil
+		}
+		if r == '\n' {
+			lex.Backup()
+			lex.Emit(TokenSceneHeading)
+			return lexParagraph
+		}
+		if r == '#' {
+			lex.Backup()
+			lex.Emit(TokenSceneHeading)
+			return lexSceneNumber
+		}
+		if !lexEscape(lex, r, TokenSceneHeading) {
+			lexNote(lex, r, TokenSceneHeading)
+		}
+	}
+}
+
+// Scene numbers are wrapped in hashes at the end of a heading, as in
+// "INT. HOUSE - DAY #12A#". A hash with no partner is part of the heading.
+func lexSceneNumber(lex *lexer.Lexer) lexer.StateFn {
+	lex.Accept("#")
+	lex.Until("#\n")
+	if !lex.Accept("#") {
+		return lexSceneHeading
+	}
+	lex.Emit(TokenSceneNumber)
+
+	lex.AcceptRun(" \t")
+	skip(lex)
+	if lex.Peek() == lexer.Eof {
+		return nil
+	}
+	if lex.Peek() == '\n' {
+		return lexParagraph
+	}
+	return lexSceneHeading
+}
+
+// A single newline continues the paragraph; more than one ends it.
 func lexParagraph(lex *lexer.Lexer) lexer.StateFn {
-	lex.AcceptRun("\n")
+	newlines := 0
+	for lex.Accept("\n") {
+		newlines++
+	}
 	lex.Emit(TokenParagraph)
-	return lexBody
+	if newlines > 1 {
+		return lexBody
+	}
+	return lexLine
 }
 
 func lexIndent(lex *lexer.Lexer) lexer.StateFn {
-	lex.AcceptRun(" ")
+	spaces := 0
+	for lex.Accept(" ") {
+		spaces++
+	}
+
+	// A line of exactly two spaces is a blank line within the paragraph.
+	r := lex.Peek()
+	if spaces == 2 && (r == '\n' || r == lexer.Eof) {
+		skip(lex)
+		return lexLine
+	}
+
 	lex.Emit(TokenIndent)
-	return lexBody
+	return lexLine
 }
 
 func lexSpeaker(lex *lexer.Lexer) lexer.StateFn {
 	lex.Emit(TokenSpeaker)
+	return lexDialogueStart
+}
+
+// lexDialogueStart lexes the newline after a cue or parenthetical, which
+// ends the dialogue if a blank line follows.
+func lexDialogueStart(lex *lexer.Lexer) lexer.StateFn {
 	lex.Accept("\n")
-	lex.Ignore()
+	if lex.Peek() == '\n' {
+		lex.Backup()
+		return lexParagraph
+	}
+	skip(lex)
 	return lexDialogue
 }
 
@@ -134,15 +679,44 @@ func lexDialogue(lex *lexer.Lexer) lexer.StateFn {
 		return lexParenthetical
 	}
 
-	if r == '\n' {
-		lex.Backup()
-		return lexParagraph
+	// Dialogue may be sung.
+	if r == '~' {
+		lex.Emit(TokenLyric)
+		return lexDialogueText
+	}
+
+	// A line of exactly two spaces is a blank line within the dialogue.
+	if r == ' ' {
+		if lex.Accept(" ") {
+			r = lex.Peek()
+			if r == '\n' || r == lexer.Eof {
+				skip(lex)
+			}
+		}
+		return lexDialogueText
 	}
 
 	lex.Backup()
 	return lexDialogueText
 }
 
+// lexDialogueBreak lexes the newline after a line of dialogue, which ends
+// the dialogue if a blank line follows.
+func lexDialogueBreak(lex *lexer.Lexer) lexer.StateFn {
+	lex.Accept("\n")
+	r := lex.Peek()
+	if r == '\n' {
+		lex.Backup()
+		return lexParagraph
+	}
+	if r == '(' {
+		skip(lex)
+		return lexDialogue
+	}
+	lex.Emit(TokenParagraph)
+	return lexDialogue
+}
+
 func lexDialogueText(lex *lexer.Lexer) lexer.StateFn {
 	for {
 		r := lex.NextRune()
@@ -155,48 +729,10 @@ func lexDialogueText(lex *lexer.Lexer) lexer.StateFn {
 		if r == '\n' {
 			lex.Backup()
 			lex.Emit(TokenDialogue)
-			lex.Accept("\n")
-			return lexDialogue
-		}
-
-		if r == '*' {
-			lex.Backup()
-			lex.Emit(TokenDialogue)
-			lex.Accept("*")
-
-			r = lex.NextRune()
-			if r == '*' {
-				lex.Emit(TokenStarDouble)
-				return lexDialogueText
-			}
-			lex.Backup()
-			lex.Emit(TokenStar)
-			return lexDialogueText
-		}
-
-		if r == '_' {
-			lex.Backup()
-			lex.Emit(TokenDialogue)
-			lex.Accept("_")
-			lex.Emit(TokenUnderscore)
-			return lexDialogueText
+			return lexDialogueBreak
 		}
 
-		if r == '[' {
-			lex.Backup()
-			lex.Emit(TokenDialogue)
-			lex.Accept("[")
-			lex.Accept("[")
-			lex.Emit(TokenCommentOpen)
-			return lexDialogueText
-		}
-
-		if r == ']' {
-			lex.Backup()
-			lex.Emit(TokenDialogue)
-			lex.Accept("]")
-			lex.Accept("]")
-			lex.Emit(TokenCommentClose)
+		if lexMarker(lex, r, TokenDialogue) {
 			return lexDialogueText
 		}
 	}
@@ -205,79 +741,314 @@ func lexDialogueText(lex *lexer.Lexer) lexer.StateFn {
 
 func lexParenthetical(lex *lexer.Lexer) lexer.StateFn {
 	lex.Accept("(")
-	lex.Ignore()
+	skip(lex)
 
 	lex.Until(")")
 	lex.Emit(TokenParenthetical)
 
 	lex.Accept(")")
-	lex.Accept("\n")
-	lex.Ignore()
+	skip(lex)
 
-	return lexDialogue
+	return lexDialogueStart
 }
 
-func lexText(lex *lexer.Lexer) lexer.StateFn {
+// Boneyard cuts material out of the script from /* to */, across lines and
+// paragraphs.
+func lexBoneyard(lex *lexer.Lexer) lexer.StateFn {
+	lex.Accept("/")
+	if !lex.Accept("*") {
+		return lexLineContent(lex, "/", true)
+	}
+	skip(lex)
+	if !lexBoneyardContent(lex) {
+		return nil
+	}
+
+	lex.AcceptRun(" ")
+	skip(lex)
+	if lex.Peek() == lexer.Eof {
+		return nil
+	}
+	if lex.Peek() == '\n' {
+		return lexParagraph
+	}
+	return lexBody
+}
+
+// lexBoneyardContent emits everything up to the closing */ and skips past
+// it. It reports false if the source ends first.
+func lexBoneyardContent(lex *lexer.Lexer) bool {
 	for {
 		r := lex.NextRune()
-
 		if r == lexer.Eof {
-			lex.Emit(TokenText)
-			return nil
+			lex.Emit(TokenBoneyard)
+			lex.Emit(TokenUnclosed)
+			return false
 		}
-
-		if r == '\n' {
+		if r == '*' && lex.Peek() == '/' {
 			lex.Backup()
-			lex.Emit(TokenText)
-			return lexParagraph
+			lex.Emit(TokenBoneyard)
+			lex.Accept("*")
+			lex.Accept("/")
+			skip(lex)
+			return true
 		}
+	}
+}
 
-		if r == '*' {
-			lex.Backup()
-			lex.Emit(TokenText)
-			lex.Accept("*")
+// A backslash before any of these makes it plain text.
+const escapable = "\\*_[]/<>~!@#.=^"
 
-			r = lex.NextRune()
-			if r == '*' {
-				lex.Emit(TokenStarDouble)
-				return lexText
-			}
-			lex.Backup()
+// lexMarker handles a style, note or boneyard marker or an escape r that has
+// just been consumed, first emitting the text before it as a token of type
+// text. It reports false, leaving the lexer alone, if r is not a marker.
+func lexMarker(lex *lexer.Lexer, r rune, text lexer.TokenType) bool {
+	if lexEscape(lex, r, text) {
+		return true
+	}
+
+	if r == '/' && lex.Peek() == '*' {
+		lex.Backup()
+		lex.Emit(text)
+		lex.Accept("/")
+		lex.Accept("*")
+		skip(lex)
+		lexBoneyardContent(lex)
+		return true
+	}
+
+	if lexNote(lex, r, text) {
+		return true
+	}
+
+	if strings.IndexRune("*_", r) < 0 {
+		return false
+	}
+
+	lex.Backup()
+	lex.Emit(text)
+
+	if r == '*' {
+		lex.Accept("*")
+		if lex.Accept("*") {
+			lex.Emit(TokenStarDouble)
+		} else {
 			lex.Emit(TokenStar)
-			return lexText
 		}
+	}
+
+	if r == '_' {
+		lex.Accept("_")
+		lex.Emit(TokenUnderscore)
+	}
+	return true
+}
 
-		if r == '_' {
+// lexEscape drops the backslash r, which has just been consumed, if it
+// escapes the rune after it, first emitting the text before it as a token of
+// type text. The escaped rune is left as text. It reports false, leaving the
+// lexer alone, if r is not an escape.
+func lexEscape(lex *lexer.Lexer, r rune, text lexer.TokenType) bool {
+	if r != '\\' || strings.IndexRune(escapable, lex.Peek()) < 0 {
+		return false
+	}
+	lex.Backup()
+	lex.Emit(text)
+	lex.Accept("\\")
+	skip(lex)
+	lex.NextRune()
+	return true
+}
+
+// lexNote lexes a note opened by r, which has just been consumed, first
+// emitting the text before it as a token of type text. It reports false,
+// leaving the lexer alone, if r does not open a note.
+func lexNote(lex *lexer.Lexer, r rune, text lexer.TokenType) bool {
+	if r != '[' || lex.Peek() != '[' {
+		return false
+	}
+	lex.Backup()
+	lex.Emit(text)
+	lex.Accept("[")
+	lex.Accept("[")
+	lex.Emit(TokenCommentOpen)
+	lexNoteContent(lex, text)
+	return true
+}
+
+// lexNoteContent emits the text of a note, which may run across lines and
+// paragraphs, and then its closing marker.
+func lexNoteContent(lex *lexer.Lexer, text lexer.TokenType) {
+	for {
+		r := lex.NextRune()
+		if r == lexer.Eof {
+			lex.Emit(text)
+			lex.Emit(TokenUnclosed)
+			return
+		}
+		if r == ']' && lex.Peek() == ']' {
 			lex.Backup()
-			lex.Emit(TokenText)
-			lex.Accept("_")
-			lex.Emit(TokenUnderscore)
-			return lexText
+			lex.Emit(text)
+			lex.Accept("]")
+			lex.Accept("]")
+			lex.Emit(TokenCommentClose)
+			return
 		}
+	}
+}
 
-		if r == '[' {
-			lex.Backup()
+func lexText(lex *lexer.Lexer) lexer.StateFn {
+	for {
+		r := lex.NextRune()
+
+		if r == lexer.Eof {
 			lex.Emit(TokenText)
-			lex.Accept("[")
-			lex.Accept("[")
-			lex.Emit(TokenCommentOpen)
-			return lexText
+			return nil
 		}
 
-		if r == ']' {
+		if r == '\n' {
 			lex.Backup()
 			lex.Emit(TokenText)
-			lex.Accept("]")
-			lex.Accept("]")
-			lex.Emit(TokenCommentClose)
+			return lexParagraph
+		}
+
+		if lexMarker(lex, r, TokenText) {
 			return lexText
 		}
 	}
 	return nil
 }
 
+// hasTitlePage reports whether src opens with a title page: a block of
+// "Key: value" lines, with values possibly continued on indented lines. Keys
+// must not be in capitals, so that "FADE IN:" opens the body.
+func hasTitlePage(src string) bool {
+	block := src
+	if i := strings.Index(src, "\n\n"); i >= 0 {
+		block = src[:i]
+	}
+	for i, line := range strings.Split(block, "\n") {
+		if i > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			continue
+		}
+		if !isDataKey(line) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDataKey(line string) bool {
+	i := strings.Index(line, ":")
+	if i <= 0 {
+		return false
+	}
+	key := line[:i]
+	for j, r := range key {
+		if j == 0 && !unicode.IsLetter(r) {
+			return false
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != ' ' && r != '-' {
+			return false
+		}
+	}
+	return strings.IndexFunc(key, unicode.IsLower) >= 0
+}
+
 func Tokenize(src string) *lexer.Lexer {
-	lex := lexer.NewLexer(src)
-	go lex.Run(lexDataBlock)
+	return TokenizeContext(context.Background(), src)
+}
+
+// TokenizeContext is like Tokenize, but stops lexing once ctx is done. The
+// tokens left unread then are discarded, so a caller that stops reading
+// early need only cancel ctx for the lexer's goroutine to exit.
+func TokenizeContext(ctx context.Context, src string) *lexer.Lexer {
+	text := newSource(src).text
+	return withoutSkips(ctx, tokenize(ctx, text), text)
+}
+
+// margin is put before the text so that nextLineBlank has something to
+// back up over even on the first line. The lexer passes over it first.
+const margin = "   "
+
+// tokenize lexes text that has already been cleaned up by newSource. The
+// text passed over between tokens is emitted as tokenSkip.
+func tokenize(ctx context.Context, text string) *lexer.Lexer {
+	lex := lexer.NewLexer(margin + text)
+	var first lexer.StateFn = lexBody
+	if hasTitlePage(text) {
+		first = lexDataBlock
+	}
+	start := func(lex *lexer.Lexer) lexer.StateFn {
+		for range margin {
+			lex.NextRune()
+		}
+		skip(lex)
+		return first
+	}
+	run(ctx, lex, start)
 	return lex
 }
+
+// withoutSkips passes on the tokens of tokens, which lexes margin + text,
+// apart from tokenSkip.
+func withoutSkips(ctx context.Context, tokens *lexer.Lexer, text string) *lexer.Lexer {
+	lex := lexer.NewLexer(margin + text)
+	var state lexer.StateFn
+	state = func(lex *lexer.Lexer) lexer.StateFn {
+		tok, ok := tokens.Next()
+		if !ok {
+			return nil
+		}
+		for range tok.Value {
+			lex.NextRune()
+		}
+		if tok.Type == tokenSkip {
+			lex.Ignore()
+		} else {
+			lex.Emit(tok.Type)
+		}
+		return state
+	}
+	run(ctx, lex, state)
+	return lex
+}
+
+// run runs lex from start in a goroutine. Once ctx is done, the lexer stops
+// and the tokens left unread are discarded, so the goroutine exits even if
+// nothing reads them.
+func run(ctx context.Context, lex *lexer.Lexer, start lexer.StateFn) {
+	done := make(chan struct{})
+	go func() {
+		lex.Run(withContext(ctx, start))
+		close(done)
+	}()
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				for {
+					if _, ok := lex.Next(); !ok {
+						return
+					}
+				}
+			case <-done:
+			}
+		}()
+	}
+}
+
+// withContext wraps state, and each state after it, to stop once ctx is
+// done.
+func withContext(ctx context.Context, state lexer.StateFn) lexer.StateFn {
+	return func(lex *lexer.Lexer) lexer.StateFn {
+		if ctx.Err() != nil {
+			return nil
+		}
+		next := state(lex)
+		if next == nil {
+			return nil
+		}
+		return withContext(ctx, next)
+	}
+}
@@ -1,7 +1,11 @@
 package fountain
 
 import (
+	"context"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/exupero/state-lexer"
 )
@@ -229,3 +233,550 @@ The End`
 		lexer.Token{TokenText, "The End"},
 	})
 }
+
+func TestSceneHeading(t *testing.T) {
+	script := `Title: The One Day
+
+INT. KITCHEN - NIGHT
+
+The BOY eats.
+
+ext. garden - day`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenSceneHeading, "INT. KITCHEN - NIGHT"},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "The BOY eats."},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenSceneHeading, "ext. garden - day"},
+	})
+}
+
+func TestForcedSceneHeading(t *testing.T) {
+	script := `Title: The One Day
+
+.FLASHBACK #12A#
+
+...and then it pours.
+
+INT. APARTMENT #5 - DAY`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenSceneHeading, "FLASHBACK "},
+		lexer.Token{TokenSceneNumber, "#12A#"},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "...and then it pours."},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenSceneHeading, "INT. APARTMENT "},
+		lexer.Token{TokenSceneHeading, "#5 - DAY"},
+	})
+}
+
+func TestTransition(t *testing.T) {
+	script := `Title: The One Day
+
+The BOY waves.
+
+CUT TO:
+
+SMASH CUT TO:
+The GIRL waves back.
+
+> FADE OUT.`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "The BOY waves."},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenTransition, "CUT TO:"},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenSpeaker, "SMASH CUT TO:"},
+		lexer.Token{TokenDialogue, "The GIRL waves back."},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenTransition, "FADE OUT."},
+	})
+}
+
+func TestCentered(t *testing.T) {
+	script := `Title: The One Day
+
+> THE *END* <
+
+>Once upon a time<
+>in the < West<`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenCentered, "THE "},
+		lexer.Token{TokenStar, "*"},
+		lexer.Token{TokenCentered, "END"},
+		lexer.Token{TokenStar, "*"},
+		lexer.Token{TokenCentered, " "},
+		lexer.Token{TokenCenteredClose, "<"},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenCentered, "Once upon a time"},
+		lexer.Token{TokenCenteredClose, "<"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenCentered, "in the "},
+		lexer.Token{TokenCentered, "< West"},
+		lexer.Token{TokenCenteredClose, "<"},
+	})
+}
+
+func TestPageBreak(t *testing.T) {
+	script := `Title: The One Day
+
+The BOY sleeps.
+
+===
+
+The BOY wakes.
+
+== is not a break`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "The BOY sleeps."},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenPageBreak, "==="},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "The BOY wakes."},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "== is not a break"},
+	})
+}
+
+func TestPageBreakWithinParagraph(t *testing.T) {
+	script := `The BOY sleeps.
+===
+The BOY wakes.
+= not a synopsis`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenText, "The BOY sleeps."},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenPageBreak, "==="},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "The BOY wakes."},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "= not a synopsis"},
+	})
+}
+
+func TestSectionsAndSynopses(t *testing.T) {
+	script := `Title: The One Day
+
+# Act One
+
+= The BOY wakes up.
+
+## Morning`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenSection, "#"},
+		lexer.Token{TokenText, "Act One"},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenSynopsis, "The BOY wakes up."},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenSection, "##"},
+		lexer.Token{TokenText, "Morning"},
+	})
+}
+
+func TestBoneyard(t *testing.T) {
+	script := `Title: The One Day
+
+/* INT. ATTIC - DAY
+
+GHOST
+Boo! */
+
+The BOY runs /* very */ fast.`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenBoneyard, " INT. ATTIC - DAY\n\nGHOST\nBoo! "},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "The BOY runs "},
+		lexer.Token{TokenBoneyard, " very "},
+		lexer.Token{TokenText, " fast."},
+	})
+}
+
+func TestUnclosedBoneyard(t *testing.T) {
+	script := `Title: The One Day
+
+He waits. /* cut`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "He waits. "},
+		lexer.Token{TokenBoneyard, " cut"},
+		lexer.Token{TokenUnclosed, ""},
+		lexer.Token{TokenText, ""},
+	})
+}
+
+func TestCommentInSceneHeading(t *testing.T) {
+	script := `INT. HOUSE - DAY [[check]] #1#
+
+# Act One [[rename]]`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenSceneHeading, "INT. HOUSE - DAY "},
+		lexer.Token{TokenCommentOpen, "[["},
+		lexer.Token{TokenSceneHeading, "check"},
+		lexer.Token{TokenCommentClose, "]]"},
+		lexer.Token{TokenSceneHeading, " "},
+		lexer.Token{TokenSceneNumber, "#1#"},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenSection, "#"},
+		lexer.Token{TokenText, "Act One "},
+		lexer.Token{TokenCommentOpen, "[["},
+		lexer.Token{TokenText, "rename"},
+		lexer.Token{TokenCommentClose, "]]"},
+		lexer.Token{TokenText, ""},
+	})
+}
+
+func TestMultilineComment(t *testing.T) {
+	script := `Title: The One Day
+
+The BOY [[Is this
+right?
+
+Check.]] runs [away].`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "The BOY "},
+		lexer.Token{TokenCommentOpen, "[["},
+		lexer.Token{TokenText, "Is this\nright?\n\nCheck."},
+		lexer.Token{TokenCommentClose, "]]"},
+		lexer.Token{TokenText, " runs [away]."},
+	})
+}
+
+func TestSpeakerExtensions(t *testing.T) {
+	script := `Title: The One Day
+
+BOY (V.O.) (cont'd)
+I was there.
+
+BOY (to himself) quietly
+No.`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenSpeaker, "BOY (V.O.) (cont'd)"},
+		lexer.Token{TokenDialogue, "I was there."},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "BOY (to himself) quietly"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "No."},
+	})
+}
+
+func TestForcedSpeakerAndAction(t *testing.T) {
+	script := `Title: The One Day
+
+@McCLANE
+Yippee ki-yay.
+
+!BOOM
+!THE TOWER SHAKES.`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenSpeaker, "McCLANE"},
+		lexer.Token{TokenDialogue, "Yippee ki-yay."},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "BOOM"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "THE TOWER SHAKES."},
+	})
+}
+
+func TestLyric(t *testing.T) {
+	script := `Title: The Musical
+
+~Willy Wonka! *Willy Wonka!*
+~The amazing chocolatier!`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The Musical"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenLyric, "~"},
+		lexer.Token{TokenText, "Willy Wonka! "},
+		lexer.Token{TokenStar, "*"},
+		lexer.Token{TokenText, "Willy Wonka!"},
+		lexer.Token{TokenStar, "*"},
+		lexer.Token{TokenText, ""},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenLyric, "~"},
+		lexer.Token{TokenText, "The amazing chocolatier!"},
+	})
+}
+
+func TestMultilineData(t *testing.T) {
+	script := `Title:
+	_**BRICK & STEEL**_
+	_**FULL RETIRED**_
+Contact:
+    Next Level Productions
+    1588 Mission Dr.
+Credit: Written By`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "_**BRICK & STEEL**_"},
+		lexer.Token{TokenDataValue, "_**FULL RETIRED**_"},
+		lexer.Token{TokenDataKey, "Contact"},
+		lexer.Token{TokenDataValue, "Next Level Productions"},
+		lexer.Token{TokenDataValue, "1588 Mission Dr."},
+		lexer.Token{TokenDataKey, "Credit"},
+		lexer.Token{TokenDataValue, "Written By"},
+	})
+}
+
+func TestEscapes(t *testing.T) {
+	script := `Title: The One Day
+
+Steel\*, the *man*.
+\#1 FAN`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "Steel"},
+		lexer.Token{TokenText, "*, the "},
+		lexer.Token{TokenStar, "*"},
+		lexer.Token{TokenText, "man"},
+		lexer.Token{TokenStar, "*"},
+		lexer.Token{TokenText, "."},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, ""},
+		lexer.Token{TokenText, "#1 FAN"},
+	})
+}
+
+func TestEscapesInHeadings(t *testing.T) {
+	script := `Title: The One Day
+
+INT. HOUSE \#1# - DAY
+
+# Act \[[1\]]`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenSceneHeading, "INT. HOUSE "},
+		lexer.Token{TokenSceneHeading, "#1"},
+		lexer.Token{TokenSceneHeading, "# - DAY"},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenSection, "#"},
+		lexer.Token{TokenText, "Act "},
+		lexer.Token{TokenText, "[[1"},
+		lexer.Token{TokenText, "]]"},
+	})
+}
+
+func TestUnicodeCues(t *testing.T) {
+	script := `Title: The One Day
+
+ΓΙΑΝΝΗΣ
+Γεια σου.
+
+Иван входит в комнату.
+
+1984
+...
+
+東京の夜。`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenSpeaker, "ΓΙΑΝΝΗΣ"},
+		lexer.Token{TokenDialogue, "Γεια σου."},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "Иван входит в комнату."},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "1984"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "..."},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "東京の夜。"},
+	})
+}
+
+func TestCapitalizedAction(t *testing.T) {
+	script := `Title: The One Day
+
+BANG!
+
+He ducks.
+A SHOT RINGS OUT.
+BOB
+Get down!
+
+THE DOOR EXPLODES.`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "BANG!"},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "He ducks."},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "A SHOT RINGS OUT."},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "BOB"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "Get down!"},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "THE DOOR EXPLODES."},
+	})
+}
+
+func TestNoTitlePage(t *testing.T) {
+	script := `FADE IN:
+
+A CROWD gathers.`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenText, "FADE IN:"},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "A CROWD gathers."},
+	})
+}
+
+func TestLineEndings(t *testing.T) {
+	script := "\ufeffTitle: The One Day\r\nCredit: Written By\r\n\r\nBOB\rHello.\r\rA CROWD gathers.\r\n"
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenDataKey, "Credit"},
+		lexer.Token{TokenDataValue, "Written By"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenSpeaker, "BOB"},
+		lexer.Token{TokenDialogue, "Hello."},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "A CROWD gathers."},
+	})
+}
+
+func TestTwoSpaceLines(t *testing.T) {
+	script := "Title: The One Day\n\nBOB\nFirst verse.\n  \nSecond verse.\n\nHe waits.\n  \nAnd waits."
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenDataKey, "Title"},
+		lexer.Token{TokenDataValue, "The One Day"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenSpeaker, "BOB"},
+		lexer.Token{TokenDialogue, "First verse."},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenDialogue, ""},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenDialogue, "Second verse."},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "He waits."},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenText, "And waits."},
+	})
+}
+
+func TestLyricInDialogue(t *testing.T) {
+	script := `BOB
+~Happy birthday
+to *you*.`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenSpeaker, "BOB"},
+		lexer.Token{TokenLyric, "~"},
+		lexer.Token{TokenDialogue, "Happy birthday"},
+		lexer.Token{TokenParagraph, "\n"},
+		lexer.Token{TokenDialogue, "to "},
+		lexer.Token{TokenStar, "*"},
+		lexer.Token{TokenDialogue, "you"},
+		lexer.Token{TokenStar, "*"},
+		lexer.Token{TokenDialogue, "."},
+	})
+}
+
+func TestShortCueBeforeWideRune(t *testing.T) {
+	lexer.AssertStream(t, Tokenize, "A\n你好", []lexer.Token{
+		lexer.Token{TokenSpeaker, "A"},
+		lexer.Token{TokenDialogue, "你好"},
+	})
+	lexer.AssertStream(t, Tokenize, "OK\n😀", []lexer.Token{
+		lexer.Token{TokenSpeaker, "OK"},
+		lexer.Token{TokenDialogue, "😀"},
+	})
+	lexer.AssertStream(t, Tokenize, "He runs.\n\n\nA\n😀", []lexer.Token{
+		lexer.Token{TokenText, "He runs."},
+		lexer.Token{TokenParagraph, "\n\n\n"},
+		lexer.Token{TokenSpeaker, "A"},
+		lexer.Token{TokenDialogue, "😀"},
+	})
+}
+
+func TestTokenizeContext(t *testing.T) {
+	script := strings.Repeat("He waits.\n\n", 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	lex := TokenizeContext(ctx, script)
+
+	lex.Next()
+	cancel()
+	count := 0
+	for {
+		if _, ok := lex.Next(); !ok {
+			break
+		}
+		count++
+	}
+	if count >= 1000 {
+		t.Errorf("Lexer did not stop when canceled, but emitted %d more tokens", count)
+	}
+}
+
+func TestTokenizeContextAbandoned(t *testing.T) {
+	before := runtime.NumGoroutine()
+	script := strings.Repeat("He waits.\n\n", 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	lex := TokenizeContext(ctx, script)
+
+	lex.Next()
+	cancel()
+	after := runtime.NumGoroutine()
+	for i := 0; i < 100 && after > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if after > before {
+		t.Errorf("Lexer did not exit when canceled, but left %d goroutines running", after-before)
+	}
+	runtime.KeepAlive(lex)
+}
+
+func TestActionAfterParenthetical(t *testing.T) {
+	script := `BOB
+(beat)
+
+He runs away.`
+	lexer.AssertStream(t, Tokenize, script, []lexer.Token{
+		lexer.Token{TokenSpeaker, "BOB"},
+		lexer.Token{TokenParenthetical, "beat"},
+		lexer.Token{TokenParagraph, "\n\n"},
+		lexer.Token{TokenText, "He runs away."},
+	})
+}
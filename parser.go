@@ -1,70 +1,399 @@
 package fountain
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/exupero/state-lexer"
 )
 
 type Parser struct {
 	lexer *lexer.Lexer
+	ctx context.Context
+	cancel context.CancelFunc
 	Doc *Document
-	hasNext bool
-	next lexer.Token
+	source *source
+	// cursor is how far into the source tokens have been found.
+	cursor int
+	pending []located
+	// start is where in the source the token last returned by Next starts.
+	start int
+	// openNote and openBoneyard are where the last note and boneyard
+	// opened, or -1.
+	openNote, openBoneyard int
+	diagnostics []Diagnostic
+	// emit, if set, is given each paragraph once nothing more can change
+	// it, and the paragraph is dropped from the body. flushed counts them.
+	emit func(Paragraph) error
+	flushed int
+	err error
+}
+
+// located is a token and the offset in the source at which it starts.
+type located struct {
+	lexer.Token
+	start int
 }
 
 type state func(*Parser) state
 
 func Parse(src string) *Document {
-	parser := &Parser{
-		lexer: Tokenize(src),
+	doc, _, _ := ParseDiagnostics(src)
+	return doc
+}
+
+// ParseDiagnostics parses src like Parse, and also reports what is wrong
+// with it. The error is the first diagnostic that is an error, if any.
+func ParseDiagnostics(src string) (*Document, []Diagnostic, error) {
+	return ParseContext(context.Background(), src)
+}
+
+// ParseContext is like ParseDiagnostics, but gives up once ctx is done and
+// returns its error.
+func ParseContext(ctx context.Context, src string) (*Document, []Diagnostic, error) {
+	parser := newParser(ctx, src)
+	parser.run()
+	return parser.result()
+}
+
+// ParseReader reads all of r and parses it like ParseDiagnostics. An error
+// reading r is returned as is, with no document.
+func ParseReader(r io.Reader) (*Document, []Diagnostic, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ParseDiagnostics(string(src))
+}
+
+// Each reads all of r and parses it, calling fn with each paragraph of the
+// body in order rather than keeping them in the document's Body, which is
+// left empty. It does not parse r as it reads: the whole script is held in
+// memory, but parsed paragraphs are not. Note and Boneyard still index
+// paragraphs as fn saw them. Each stops at the first error from fn and
+// returns it; otherwise its error is the first diagnostic that is an error,
+// as from ParseDiagnostics.
+func Each(r io.Reader, fn func(Paragraph) error) (*Document, error) {
+	return EachContext(context.Background(), r, fn)
+}
+
+// EachContext is like Each, but gives up once ctx is done and returns its
+// error.
+func EachContext(ctx context.Context, r io.Reader, fn func(Paragraph) error) (*Document, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	parser := newParser(ctx, string(src))
+	parser.emit = fn
+	parser.run()
+	parser.flush(0)
+	doc, _, err := parser.result()
+	return doc, err
+}
+
+func newParser(ctx context.Context, src string) *Parser {
+	source := newSource(src)
+	ctx, cancel := context.WithCancel(ctx)
+	return &Parser{
+		lexer: tokenize(ctx, source.text),
+		ctx: ctx,
+		cancel: cancel,
+		source: source,
 		Doc: &Document{
 			Data: make(map[string]string),
 			Body: []Paragraph{},
 		},
+		// The lexer passes over its margin before the source.
+		cursor: -len(margin),
+		openNote: -1,
+		openBoneyard: -1,
 	}
-	for state := parseDoc; state != nil; {
-		state = state(parser)
+}
+
+// run parses the script and, however parsing ends, stops the lexer and
+// waits for its goroutine to finish.
+func (p *Parser) run() {
+	defer func() {
+		p.cancel()
+		for {
+			if _, ok := p.lexer.Next(); !ok {
+				return
+			}
+		}
+	}()
+
+	for state := parseDoc; state != nil && p.err == nil; {
+		state = state(p)
+	}
+	if p.err == nil {
+		p.err = p.ctx.Err()
+	}
+	if p.err != nil {
+		return
+	}
+	if _, ok := p.Peek(); ok {
+		p.report(SeverityError, p.source.position(p.pending[0].start), "unexpected text; the rest of the script was not parsed")
 	}
-	return parser.Doc
 }
 
-func (p *Parser) Next() (lexer.Token, bool) {
-	if p.hasNext {
-		p.hasNext = false
-		return p.next, true
+// result returns what parsing found. The error is the one that stopped it,
+// if any, or else the first diagnostic that is an error.
+func (p *Parser) result() (*Document, []Diagnostic, error) {
+	if p.err != nil {
+		return p.Doc, p.diagnostics, p.err
 	}
-	return p.lexer.Next()
+	for _, d := range p.diagnostics {
+		if d.Severity == SeverityError {
+			return p.Doc, p.diagnostics, d
+		}
+	}
+	return p.Doc, p.diagnostics, nil
 }
 
-func (p *Parser) Peek() (lexer.Token, bool) {
-	tok, ok := p.lexer.Next()
+// flush hands all but the last keep paragraphs of the body to emit.
+func (p *Parser) flush(keep int) {
+	if p.emit == nil {
+		return
+	}
+	for len(p.Doc.Body) > keep {
+		if p.err == nil {
+			p.err = p.emit(p.Doc.Body[0])
+		}
+		p.Doc.Body = p.Doc.Body[1:]
+		p.flushed++
+	}
+}
+
+func (p *Parser) report(severity Severity, position Position, format string, args ...interface{}) {
+	d := Diagnostic{Severity: severity, Message: fmt.Sprintf(format, args...), Position: position}
+	p.diagnostics = append(p.diagnostics, d)
+}
+
+func (p *Parser) Next() (lexer.Token, bool) {
+	tok, ok := p.Peek()
 	if ok {
-		p.hasNext = true
-		p.next = tok
+		p.start = p.pending[0].start
+		p.pending = p.pending[1:]
 	}
 	return tok, ok
 }
 
+func (p *Parser) Peek() (lexer.Token, bool) {
+	if len(p.pending) == 0 {
+		p.fill()
+	}
+	if len(p.pending) == 0 {
+		return lexer.Token{}, false
+	}
+	return p.pending[0].Token, true
+}
+
+// fill reads the rest of a line from the lexer, so that its emphasis
+// markers can be matched up before the parser sees them.
+func (p *Parser) fill() {
+	line := []located{}
+	for {
+		tok, ok := p.lexer.Next()
+		if !ok {
+			break
+		}
+		loc := p.locate(tok)
+		if tok.Type == tokenSkip {
+			continue
+		}
+		if tok.Type == TokenUnclosed {
+			p.unclosed()
+			continue
+		}
+		p.check(loc)
+		if !isInline(tok.Type) {
+			if len(line) == 0 {
+				line = append(line, loc)
+				break
+			}
+			p.pending = append(resolveEmphasis(line), loc)
+			return
+		}
+		line = append(line, loc)
+	}
+	p.pending = resolveEmphasis(line)
+}
+
+// check notes where markup that may be left open starts.
+func (p *Parser) check(loc located) {
+	if loc.Type == TokenCommentOpen {
+		p.openNote = loc.start
+	}
+	if loc.Type == TokenCommentClose {
+		p.openNote = -1
+	}
+	if loc.Type == TokenBoneyard {
+		// Boneyard comes straight after its /*.
+		p.openBoneyard = loc.start - len("/*")
+		if p.openBoneyard < 0 {
+			p.openBoneyard = 0
+		}
+	}
+}
+
+// unclosed reports the note or boneyard that the script ends inside.
+func (p *Parser) unclosed() {
+	if p.openNote >= 0 {
+		p.report(SeverityError, p.source.position(p.openNote), "note is not closed with ]]")
+		p.openNote = -1
+		return
+	}
+	if p.openBoneyard >= 0 {
+		p.report(SeverityError, p.source.position(p.openBoneyard), "boneyard is not closed with */")
+	}
+}
+
+// locate places tok in the source. Between them, the lexer's tokens and
+// the text it skips cover the source in order, so tok starts where the last
+// one ended.
+func (p *Parser) locate(tok lexer.Token) located {
+	start := p.cursor
+	p.cursor += len(tok.Value)
+	return located{tok, start}
+}
+
+// span returns the span of part, which is found in the value of tok, the
+// token last returned by Next.
+func (p *Parser) span(tok lexer.Token, part string) Span {
+	start := p.start
+	if i := strings.Index(tok.Value, part); i >= 0 {
+		start += i
+	}
+	return p.source.span(start, start+len(part))
+}
+
+func isText(t lexer.TokenType) bool {
+	return t == TokenText || t == TokenDialogue || t == TokenCentered
+}
+
+func isEmphasis(t lexer.TokenType) bool {
+	return t == TokenStar || t == TokenStarDouble || t == TokenUnderscore
+}
+
+// isInline reports whether tokens of type t can sit within a line.
+func isInline(t lexer.TokenType) bool {
+	return isText(t) || isEmphasis(t) || t == TokenIndent || t == TokenCommentOpen || t == TokenCommentClose || t == TokenBoneyard
+}
+
+// resolveEmphasis turns emphasis markers in line that have no partner into
+// text. An opening marker must be followed by something other than a space,
+// and a closing marker must follow something other than a space.
+func resolveEmphasis(line []located) []located {
+	paired := make([]bool, len(line))
+	open := map[lexer.TokenType]int{}
+	for i, tok := range line {
+		if !isEmphasis(tok.Type) {
+			continue
+		}
+		before, after := around(line, i)
+		if j, ok := open[tok.Type]; ok && before != 0 && !unicode.IsSpace(before) {
+			paired[i], paired[j] = true, true
+			delete(open, tok.Type)
+			continue
+		}
+		if after != 0 && !unicode.IsSpace(after) {
+			open[tok.Type] = i
+		}
+	}
+
+	resolved := []located{}
+	textType := TokenText
+	for i, tok := range line {
+		if isText(tok.Type) {
+			textType = tok.Type
+		}
+		if isEmphasis(tok.Type) && !paired[i] {
+			tok.Type = textType
+		}
+
+		// Join text that is no longer split by a marker, as long as nothing
+		// was skipped between them.
+		last := len(resolved) - 1
+		if last >= 0 && isText(tok.Type) && resolved[last].Type == tok.Type && resolved[last].start+len(resolved[last].Value) == tok.start {
+			resolved[last].Value += tok.Value
+			continue
+		}
+		resolved = append(resolved, tok)
+	}
+	return resolved
+}
+
+// around returns the runes on either side of line[i], or zero at the ends
+// of the line.
+func around(line []located, i int) (rune, rune) {
+	before, after := "", ""
+	for j, tok := range line {
+		if tok.Type == TokenBoneyard {
+			continue
+		}
+		if j < i {
+			before += tok.Value
+		}
+		if j > i {
+			after += tok.Value
+		}
+	}
+	b, _ := utf8.DecodeLastRuneInString(before)
+	a, _ := utf8.DecodeRuneInString(after)
+	if before == "" {
+		b = 0
+	}
+	if after == "" {
+		a = 0
+	}
+	return b, a
+}
+
 func parseDoc(p *Parser) state {
-	return parseData
+	tok, ok := p.Peek()
+	if !ok {
+		return nil
+	}
+	if tok.Type == TokenDataKey {
+		return parseData
+	}
+	return parseParagraph
 }
 
 func parseData(p *Parser) state {
 	for {
 		tok, ok := p.Next()
-		if !ok || tok.Type != TokenDataKey {
-			if tok.Type == TokenParagraph {
-				return parseParagraph
-			}
+		if !ok {
+			return nil
+		}
+		if tok.Type == TokenParagraph {
+			return parseParagraph
+		}
+		if tok.Type != TokenDataKey {
+			return nil
 		}
 		key := tok.Value
 
-		tok, ok = p.Next()
-		if !ok || tok.Type != TokenDataValue {
-			return nil
+		// Values may run across several lines, one token each.
+		values := []string{}
+		for {
+			tok, ok = p.Peek()
+			if !ok || tok.Type != TokenDataValue {
+				break
+			}
+			p.Next()
+			values = append(values, tok.Value)
 		}
-		value := tok.Value
+		if len(values) == 0 {
+			p.report(SeverityWarning, p.source.position(p.start), "title page key %q has no value", key)
+		}
+		value := strings.Join(values, "\n")
+		p.Doc.TitlePage = append(p.Doc.TitlePage, TitlePageEntry{Key: key, Value: value})
 
 		if key == "Title" {
 			p.Doc.Title = value
@@ -99,9 +428,371 @@ func parseParagraph(p *Parser) state {
 	if tok.Type == TokenSpeaker {
 		return parseDialogue
 	}
+	if tok.Type == TokenBoneyard {
+		return parseBoneyard
+	}
+	if tok.Type == TokenSceneHeading {
+		return parseSceneHeading
+	}
+	if tok.Type == TokenTransition {
+		return parseTransition
+	}
+	if tok.Type == TokenCentered && p.centeredClosed() {
+		return parseCentered
+	}
+	if tok.Type == TokenCentered {
+		return parseTransition
+	}
+	if tok.Type == TokenSection {
+		return parseSection
+	}
+	if tok.Type == TokenSynopsis {
+		return parseSynopsis
+	}
+	if tok.Type == TokenLyric {
+		return parseLyric
+	}
+	if tok.Type == TokenPageBreak {
+		p.Next()
+		paragraph := Paragraph{Lines: []Line{}, Type: "page-break", Span: p.span(tok, tok.Value)}
+		return endParagraph(p, paragraph)
+	}
 	return parseAction
 }
 
+// parseBoneyard sets aside material cut between paragraphs.
+func parseBoneyard(p *Parser) state {
+	tok, _ := p.Next()
+	p.cut(tok)
+
+	tok, ok := p.Peek()
+	if !ok {
+		return nil
+	}
+	if tok.Type == TokenParagraph {
+		p.Next()
+	}
+	return parseParagraph
+}
+
+// cut sets aside boneyard tok, anchored to the paragraph being parsed.
+func (p *Parser) cut(tok lexer.Token) {
+	boneyard := Boneyard{Content: tok.Value, Paragraph: p.flushed + len(p.Doc.Body)}
+	p.Doc.boneyard = append(p.Doc.boneyard, boneyard)
+}
+
+// opensParagraph reports whether the next line starts a new paragraph even
+// though no blank line precedes it.
+func opensParagraph(p *Parser) bool {
+	tok, ok := p.Peek()
+	return ok && (tok.Type == TokenTransition || tok.Type == TokenCentered || tok.Type == TokenLyric || tok.Type == TokenPageBreak)
+}
+
+// add appends paragraph to the body, noting any notes written in it.
+func (p *Parser) add(paragraph Paragraph) {
+	spanLines(&paragraph)
+	p.note(paragraph, p.flushed+len(p.Doc.Body), 0)
+
+	// Dialogue may yet be paired with the paragraph after it.
+	p.flush(0)
+	p.Doc.Body = append(p.Doc.Body, paragraph)
+	if !paragraph.IsDialogue() {
+		p.flush(0)
+	}
+}
+
+// spanLines spans each line of paragraph from its first chunk to its last,
+// and the paragraph from its first line to its last.
+func spanLines(paragraph *Paragraph) {
+	for i := range paragraph.Lines {
+		line := &paragraph.Lines[i]
+		if len(line.Chunks) > 0 && line.Span == (Span{}) {
+			line.Span = Span{Start: line.Chunks[0].Span.Start, End: line.Chunks[len(line.Chunks)-1].Span.End}
+		}
+		if line.Span == (Span{}) {
+			continue
+		}
+		if paragraph.Span == (Span{}) {
+			paragraph.Span.Start = line.Span.Start
+		}
+		paragraph.Span.End = line.Span.End
+	}
+}
+
+// pair sets dialogue paragraph beside the dialogue before it. Without one,
+// it is added on its own.
+func (p *Parser) pair(paragraph Paragraph) {
+	spanLines(&paragraph)
+	last := len(p.Doc.Body) - 1
+	if last < 0 || !p.Doc.Body[last].IsDialogue() {
+		p.report(SeverityWarning, paragraph.Span.Start, "dual dialogue has no dialogue before it")
+		p.add(paragraph)
+		return
+	}
+	p.note(paragraph, p.flushed+last, 1)
+	// Boneyard in the right column was anchored to the paragraph after the
+	// left, which the pair now replaces.
+	for i := len(p.Doc.boneyard) - 1; i >= 0 && p.Doc.boneyard[i].Paragraph > p.flushed+last; i-- {
+		p.Doc.boneyard[i].Paragraph = p.flushed + last
+	}
+	p.Doc.Body[last] = Paragraph{
+		Lines: []Line{},
+		Type: "dual-dialogue",
+		Columns: []Paragraph{p.Doc.Body[last], paragraph},
+		Span: Span{Start: p.Doc.Body[last].Span.Start, End: paragraph.Span.End},
+	}
+}
+
+func (p *Parser) note(paragraph Paragraph, index, column int) {
+	for i, line := range paragraph.Lines {
+		for _, chunk := range line.Chunks {
+			if chunk.isNote() {
+				note := Note{Content: chunk.Content, Paragraph: index, Column: column, Line: i}
+				p.Doc.notes = append(p.Doc.notes, note)
+			}
+		}
+	}
+}
+
+// endParagraph adds a paragraph that fits on one line to the body and
+// consumes the break after it.
+func endParagraph(p *Parser, paragraph Paragraph) state {
+	p.add(paragraph)
+
+	tok, ok := p.Peek()
+	if !ok {
+		return nil
+	}
+	if tok.Type == TokenParagraph {
+		p.Next()
+	}
+	return parseParagraph
+}
+
+func parseSceneHeading(p *Parser) state {
+	heading, number := notedText{start: -1}, ""
+	line := []located{}
+	for {
+		tok, ok := p.Peek()
+		if !ok || (tok.Type != TokenSceneHeading && tok.Type != TokenSceneNumber && !isNoteMarker(tok.Type)) {
+			break
+		}
+		p.Next()
+		line = append(line, located{tok, p.start})
+		if tok.Type == TokenSceneNumber {
+			number = strings.Trim(tok.Value, "#")
+			continue
+		}
+		heading.add(p, tok)
+	}
+
+	// A heading needs a blank line after it, unless it was forced with a
+	// dot, which is skipped just before it. Otherwise it opens action.
+	tok, ok := p.Peek()
+	forced := line[0].start > 0 && p.source.text[line[0].start-1] == '.'
+	if ok && tok.Type == TokenParagraph && tok.Value == "\n" && !forced {
+		for i := range line {
+			if !isNoteMarker(line[i].Type) {
+				line[i].Type = TokenText
+			}
+		}
+		p.pending = append(line, p.pending...)
+		return parseAction
+	}
+
+	chunks := heading.chunks(p)
+	scene := parseScene(chunks[0].Content)
+	scene.Number = number
+	paragraph := Paragraph{
+		Lines: []Line{
+			Line{
+				Chunks: chunks,
+				Type: "scene-heading",
+			},
+		},
+		Type: "scene-heading",
+		Scene: scene,
+	}
+	return endParagraph(p, paragraph)
+}
+
+// notedText gathers the text of a line that may have notes in it, keeping
+// the notes apart.
+type notedText struct {
+	text string
+	// start and end are where the trimmed text runs in the source, or -1.
+	start, end int
+	notes []Chunk
+	inNote bool
+}
+
+func isNoteMarker(t lexer.TokenType) bool {
+	return t == TokenCommentOpen || t == TokenCommentClose
+}
+
+// add takes tok, just returned by p.Next.
+func (n *notedText) add(p *Parser, tok lexer.Token) {
+	if tok.Type == TokenCommentOpen {
+		n.inNote = true
+		return
+	}
+	if tok.Type == TokenCommentClose {
+		n.inNote = false
+		return
+	}
+	if n.inNote {
+		// A note left open runs to the end of the line, after which the
+		// lexer may emit an empty token that is not part of it.
+		if tok.Value == "" {
+			return
+		}
+		n.notes = append(n.notes, Chunk{Content: tok.Value, Styles: []string{"comment"}, Span: p.span(tok, tok.Value)})
+		return
+	}
+	blank := strings.Trim(n.text, " \t") == ""
+	n.text += tok.Value
+	content := strings.TrimLeft(tok.Value, " \t")
+	if content == "" {
+		// Until there is some text, it is placed where the first piece starts.
+		if n.start < 0 {
+			n.start, n.end = p.start, p.start
+		}
+		return
+	}
+	if blank {
+		n.start = p.start + len(tok.Value) - len(content)
+	}
+	n.end = p.start + len(strings.TrimRight(tok.Value, " \t"))
+}
+
+// chunks returns the text, trimmed, followed by the notes.
+func (n *notedText) chunks(p *Parser) []Chunk {
+	text := Chunk{Content: strings.Trim(n.text, " \t"), Span: p.source.span(n.start, n.end)}
+	return append([]Chunk{text}, n.notes...)
+}
+
+// centeredClosed reports whether the line being read ends with <, which
+// makes a line opened with > centered text rather than a transition.
+func (p *Parser) centeredClosed() bool {
+	return len(p.pending) > 0 && p.pending[len(p.pending)-1].Type == TokenCenteredClose
+}
+
+func parseTransition(p *Parser) state {
+	tok, _ := p.Peek()
+	if tok.Type == TokenCentered {
+		return parseStyledTransition
+	}
+	p.Next()
+	transition := strings.TrimSpace(tok.Value)
+	paragraph := Paragraph{
+		Lines: []Line{
+			Line{
+				Chunks: []Chunk{
+					Chunk{Content: transition, Span: p.span(tok, transition)},
+				},
+				Type: "transition",
+			},
+		},
+		Type: "transition",
+	}
+	return endParagraph(p, paragraph)
+}
+
+// parseStyledTransition reads a transition with markup in it, which the
+// lexer reads like centered text.
+func parseStyledTransition(p *Parser) state {
+	continues := func(next lexer.Token) bool {
+		return false
+	}
+	return parseLines(p, "transition", TokenCentered, continues, func(chunks []Chunk) Line {
+		return centeredLine(chunks, "transition")
+	})
+}
+
+func parseSection(p *Parser) state {
+	tok, _ := p.Next()
+	depth := len(tok.Value)
+
+	end := p.start + len(tok.Value)
+	title := notedText{start: -1}
+	for {
+		tok, ok := p.Peek()
+		if !ok || (tok.Type != TokenText && !isNoteMarker(tok.Type)) {
+			break
+		}
+		p.Next()
+		title.add(p, tok)
+	}
+	// A section with no title is placed just after its hashes.
+	if title.start < 0 {
+		title.start, title.end = end, end
+	}
+
+	paragraph := Paragraph{
+		Lines: []Line{
+			Line{
+				Chunks: title.chunks(p),
+				Type: "section",
+			},
+		},
+		Type: "section",
+		Depth: depth,
+	}
+	return endParagraph(p, paragraph)
+}
+
+func parseSynopsis(p *Parser) state {
+	synopsis := notedText{start: -1}
+	for {
+		tok, ok := p.Peek()
+		if !ok || (tok.Type != TokenSynopsis && !isNoteMarker(tok.Type)) {
+			break
+		}
+		p.Next()
+		synopsis.add(p, tok)
+	}
+	paragraph := Paragraph{
+		Lines: []Line{
+			Line{
+				Chunks: synopsis.chunks(p),
+				Type: "synopsis",
+			},
+		},
+		Type: "synopsis",
+	}
+	return endParagraph(p, paragraph)
+}
+
+func parseScene(heading string) *Scene {
+	scene := &Scene{}
+	upper := strings.ToUpper(heading)
+	for _, prefix := range []string{"INT./EXT", "INT/EXT", "I/E", "INT", "EXT", "EST"} {
+		if !strings.HasPrefix(upper, prefix) {
+			continue
+		}
+		switch prefix {
+		case "INT":
+			scene.Interior = true
+		case "EXT":
+			scene.Exterior = true
+		case "EST":
+		default:
+			scene.Interior = true
+			scene.Exterior = true
+		}
+		heading = strings.TrimLeft(heading[len(prefix):], ". ")
+		break
+	}
+
+	if i := strings.LastIndex(heading, " - "); i >= 0 {
+		scene.Location = strings.TrimSpace(heading[:i])
+		scene.TimeOfDay = strings.TrimSpace(heading[i+3:])
+	} else {
+		scene.Location = strings.TrimSpace(heading)
+	}
+	return scene
+}
+
 type styleManager struct {
 	bold, italic, underline, comment bool
 }
@@ -115,6 +806,25 @@ func (s *styleManager) list() []string {
 	return styles
 }
 
+// update toggles styles for the marker tok, if it is one.
+func (s *styleManager) update(tok lexer.Token) {
+	if tok.Type == TokenStarDouble {
+		s.bold = !s.bold
+	}
+	if tok.Type == TokenStar {
+		s.italic = !s.italic
+	}
+	if tok.Type == TokenUnderscore {
+		s.underline = !s.underline
+	}
+	if tok.Type == TokenCommentOpen {
+		s.comment = true
+	}
+	if tok.Type == TokenCommentClose {
+		s.comment = false
+	}
+}
+
 func parseAction(p *Parser) state {
 	style := styleManager{false, false, false, false}
 	lines := []Line{}
@@ -123,7 +833,7 @@ func parseAction(p *Parser) state {
 	defer func() {
 		lines = append(lines, Line{Chunks: chunks, Type: "action"})
 		paragraph := Paragraph{Lines: lines, Type: "action"}
-		p.Doc.Body = append(p.Doc.Body, paragraph)
+		p.add(paragraph)
 	}()
 
 	for {
@@ -132,48 +842,119 @@ func parseAction(p *Parser) state {
 			return nil
 		}
 		if tok.Type == TokenParagraph {
-			if tok.Value == "\n\n" {
+			if strings.Count(tok.Value, "\n") > 1 || opensParagraph(p) {
 				return parseParagraph
 			}
 			lines = append(lines, Line{Chunks: chunks, Type: "action"})
 			chunks = []Chunk{}
 		}
 		if tok.Type == TokenText {
-			chunks = append(chunks, Chunk{Content: tok.Value, Styles: style.list()})
+			chunks = append(chunks, Chunk{Content: tok.Value, Styles: style.list(), Span: p.span(tok, tok.Value)})
 		}
 		if tok.Type == TokenIndent {
 			s := fmt.Sprintf("indent-%d", len(tok.Value))
-			chunks = append(chunks, Chunk{Content: tok.Value, Styles: []string{s}})
+			chunks = append(chunks, Chunk{Content: tok.Value, Styles: []string{s}, Span: p.span(tok, tok.Value)})
 		}
-
-		if tok.Type == TokenStarDouble {
-			style.bold = !style.bold
+		if tok.Type == TokenBoneyard {
+			p.cut(tok)
 		}
-		if tok.Type == TokenStar {
-			style.italic = !style.italic
+
+		style.update(tok)
+	}
+	return nil
+}
+
+func parseCentered(p *Parser) state {
+	continues := func(next lexer.Token) bool {
+		return next.Type == TokenCentered && p.centeredClosed()
+	}
+	return parseLines(p, "centered", TokenCentered, continues, func(chunks []Chunk) Line {
+		return centeredLine(chunks, "centered")
+	})
+}
+
+// parseLyric collects consecutive lines of lyrics into one paragraph.
+func parseLyric(p *Parser) state {
+	continues := func(next lexer.Token) bool {
+		return next.Type == TokenLyric
+	}
+	return parseLines(p, "lyric", TokenText, continues, func(chunks []Chunk) Line {
+		return Line{Chunks: chunks, Type: "lyric"}
+	})
+}
+
+// parseLines collects lines into a paragraph of type kind, reading their
+// text from tokens of type text. A single newline goes on to another line
+// only if continues accepts the token that opens it. Each line is made from
+// its chunks by line.
+func parseLines(p *Parser, kind string, text lexer.TokenType, continues func(lexer.Token) bool, line func([]Chunk) Line) state {
+	style := styleManager{false, false, false, false}
+	lines := []Line{}
+	chunks := []Chunk{}
+
+	defer func() {
+		lines = append(lines, line(chunks))
+		paragraph := Paragraph{Lines: lines, Type: kind}
+		p.add(paragraph)
+	}()
+
+	for {
+		tok, ok := p.Next()
+		if !ok {
+			return nil
 		}
-		if tok.Type == TokenUnderscore {
-			style.underline = !style.underline
+		if tok.Type == TokenParagraph {
+			next, ok := p.Peek()
+			if strings.Count(tok.Value, "\n") > 1 || !ok || !continues(next) {
+				return parseParagraph
+			}
+			lines = append(lines, line(chunks))
+			chunks = []Chunk{}
 		}
-		if tok.Type == TokenCommentOpen {
-			style.comment = true
+		if tok.Type == text {
+			chunks = append(chunks, Chunk{Content: tok.Value, Styles: style.list(), Span: p.span(tok, tok.Value)})
 		}
-		if tok.Type == TokenCommentClose {
-			style.comment = false
+		if tok.Type == TokenBoneyard {
+			p.cut(tok)
 		}
+
+		style.update(tok)
 	}
-	return nil
+}
+
+// centeredLine makes a line of type kind, trimming the space between
+// centered text and its markers.
+func centeredLine(chunks []Chunk, kind string) Line {
+	if len(chunks) > 0 {
+		first := &chunks[0]
+		trimmed := strings.TrimLeft(first.Content, " ")
+		first.Span.Start.Offset += len(first.Content) - len(trimmed)
+		first.Span.Start.Column += len(first.Content) - len(trimmed)
+		first.Content = trimmed
+
+		last := &chunks[len(chunks)-1]
+		trimmed = strings.TrimRight(last.Content, " ")
+		last.Span.End.Offset -= len(last.Content) - len(trimmed)
+		last.Span.End.Column -= len(last.Content) - len(trimmed)
+		last.Content = trimmed
+	}
+	return Line{Chunks: chunks, Type: kind}
 }
 
 func parseDialogue(p *Parser) state {
 	lines := []Line{}
+	dual := false
 
 	defer func() {
 		paragraph := Paragraph{
 			Lines: lines,
 			Type: "dialogue",
 		}
-		p.Doc.Body = append(p.Doc.Body, paragraph)
+		if dual {
+			p.pair(paragraph)
+		} else {
+			p.add(paragraph)
+		}
 	}()
 
 	for {
@@ -181,15 +962,30 @@ func parseDialogue(p *Parser) state {
 		if !ok {
 			return nil
 		}
-		if tok.Type == TokenParagraph {
+		// A single newline only breaks lines of dialogue.
+		if tok.Type == TokenParagraph && strings.Count(tok.Value, "\n") > 1 {
 			return parseParagraph
 		}
 
 		if tok.Type == TokenSpeaker {
+			// A caret after the name puts the dialogue beside the previous.
+			speaker := strings.TrimSpace(tok.Value)
+			if strings.HasSuffix(speaker, "^") {
+				dual = true
+				speaker = strings.TrimSpace(strings.TrimSuffix(speaker, "^"))
+			}
+			chunks := parseSpeaker(speaker)
+			from := 0
+			for i := range chunks {
+				chunk := &chunks[i]
+				if j := strings.Index(tok.Value[from:], chunk.Content); j >= 0 {
+					from += j
+					chunk.Span = p.source.span(p.start+from, p.start+from+len(chunk.Content))
+					from += len(chunk.Content)
+				}
+			}
 			line := Line{
-				Chunks: []Chunk{
-					Chunk{Content: tok.Value},
-				},
+				Chunks: chunks,
 				Type: "speaker",
 			}
 			lines = append(lines, line)
@@ -197,7 +993,7 @@ func parseDialogue(p *Parser) state {
 		if tok.Type == TokenParenthetical {
 			line := Line{
 				Chunks: []Chunk{
-					Chunk{Content: tok.Value},
+					Chunk{Content: tok.Value, Span: p.span(tok, tok.Value)},
 				},
 				Type: "parenthetical",
 			}
@@ -207,13 +1003,45 @@ func parseDialogue(p *Parser) state {
 			line := collectDialogueText(p, tok)
 			lines = append(lines, line)
 		}
+		if tok.Type == TokenLyric {
+			tok, ok := p.Peek()
+			if ok && tok.Type == TokenDialogue {
+				p.Next()
+				line := collectDialogueText(p, tok)
+				line.Type = "lyric"
+				lines = append(lines, line)
+			}
+		}
 	}
 	return nil
 }
 
+// parseSpeaker splits a character cue into the character's name and a chunk
+// for each extension in parentheses after it.
+func parseSpeaker(cue string) []Chunk {
+	name := cue
+	extensions := ""
+	if i := strings.Index(cue, "("); i > 0 {
+		name, extensions = cue[:i], cue[i:]
+	}
+
+	chunks := []Chunk{Chunk{Content: strings.TrimSpace(name)}}
+	for {
+		open := strings.Index(extensions, "(")
+		close := strings.Index(extensions, ")")
+		if open < 0 || close < open {
+			break
+		}
+		extension := strings.TrimSpace(extensions[open+1 : close])
+		chunks = append(chunks, Chunk{Content: extension, Styles: []string{"extension"}})
+		extensions = extensions[close+1:]
+	}
+	return chunks
+}
+
 func collectDialogueText(p *Parser, tok lexer.Token) Line {
 	style := styleManager{false, false, false, false}
-	chunks := []Chunk{Chunk{Content: tok.Value}}
+	chunks := []Chunk{Chunk{Content: tok.Value, Span: p.span(tok, tok.Value)}}
 
 	for {
 		// Check before consuming.
@@ -224,24 +1052,13 @@ func collectDialogueText(p *Parser, tok lexer.Token) Line {
 
 		tok, _ = p.Next()
 		if tok.Type == TokenDialogue {
-			chunks = append(chunks, Chunk{Content: tok.Value, Styles: style.list()})
-		}
-
-		if tok.Type == TokenStarDouble {
-			style.bold = !style.bold
+			chunks = append(chunks, Chunk{Content: tok.Value, Styles: style.list(), Span: p.span(tok, tok.Value)})
 		}
-		if tok.Type == TokenStar {
-			style.italic = !style.italic
-		}
-		if tok.Type == TokenUnderscore {
-			style.underline = !style.underline
-		}
-		if tok.Type == TokenCommentOpen {
-			style.comment = true
-		}
-		if tok.Type == TokenCommentClose {
-			style.comment = false
+		if tok.Type == TokenBoneyard {
+			p.cut(tok)
 		}
+
+		style.update(tok)
 	}
 
 	return Line{
@@ -1,6 +1,11 @@
 package fountain
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
 
 func TestDocData(t *testing.T) {
 	script := `Title: The One Day
@@ -31,6 +36,46 @@ Quality: Pretty Good`
 	}
 }
 
+func TestDocMultilineData(t *testing.T) {
+	script := `Title:
+	BRICK & STEEL
+	FULL RETIRED
+Author: Stu Maschwitz
+Contact:
+    Next Level Productions
+    1588 Mission Dr.
+Author: Someone Else
+
+A CROWD gathers.`
+	doc := Parse(script)
+
+	if doc.Title != "BRICK & STEEL\nFULL RETIRED" {
+		t.Errorf("Title is not '%s', but is '%s'", "BRICK & STEEL\nFULL RETIRED", doc.Title)
+	}
+
+	contact := "Next Level Productions\n1588 Mission Dr."
+	if doc.Data["Contact"] != contact {
+		t.Errorf("Data[Contact] is not '%s', but is '%s'", contact, doc.Data["Contact"])
+	}
+
+	keys := []string{}
+	for _, entry := range doc.TitlePage {
+		keys = append(keys, entry.Key)
+	}
+	if strings.Join(keys, ",") != "Title,Author,Contact,Author" {
+		t.Errorf("Title page keys are not '%s', but are '%s'", "Title,Author,Contact,Author", strings.Join(keys, ","))
+	}
+
+	authors := strings.Join(doc.Values("Author"), ",")
+	if authors != "Stu Maschwitz,Someone Else" {
+		t.Errorf("Authors are not '%s', but are '%s'", "Stu Maschwitz,Someone Else", authors)
+	}
+
+	if len(doc.Body) != 1 || doc.Body[0].Text() != "A CROWD gathers." {
+		t.Errorf("Body is not '%s', but is '%v'", "A CROWD gathers.", doc.Body)
+	}
+}
+
 func TestDocTextVariants(t *testing.T) {
 	script := `Title: The One Day
 
@@ -313,13 +358,1381 @@ Not indented action.`
 	})
 }
 
+func TestDocSceneHeading(t *testing.T) {
+	script := `Title: The One Day
+
+INT./EXT. CAR - MOVING - NIGHT
+
+The BOY drives.
+
+EXT. GARDEN - DAY`
+	assertBody(t, script, []Paragraph{
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "INT./EXT. CAR - MOVING - NIGHT"},
+					},
+					Type: "scene-heading",
+				},
+			},
+			Type: "scene-heading",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "The BOY drives."},
+					},
+					Type: "action",
+				},
+			},
+			Type: "action",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "EXT. GARDEN - DAY"},
+					},
+					Type: "scene-heading",
+				},
+			},
+			Type: "scene-heading",
+		},
+	})
+
+	doc := Parse(script)
+	expected := []Scene{
+		Scene{Interior: true, Exterior: true, Location: "CAR - MOVING", TimeOfDay: "NIGHT"},
+		Scene{Exterior: true, Location: "GARDEN", TimeOfDay: "DAY"},
+	}
+	scenes := []Scene{}
+	for _, paragraph := range doc.Body {
+		if paragraph.IsSceneHeading() {
+			scenes = append(scenes, *paragraph.Scene)
+		}
+	}
+	if len(scenes) != len(expected) {
+		t.Fatalf("Scenes are not %v, but are %v", expected, scenes)
+	}
+	for i, scene := range expected {
+		if scenes[i] != scene {
+			t.Errorf("Scene %d is not %v, but is %v", i, scene, scenes[i])
+		}
+	}
+}
+
+func TestDocSceneHeadingNeedsBlankLine(t *testing.T) {
+	script := `EXT. HOUSE
+Bob is here.
+
+.FLASHBACK
+Bob was there.`
+	assertBody(t, script, []Paragraph{
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "EXT. HOUSE"},
+					},
+					Type: "action",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "Bob is here."},
+					},
+					Type: "action",
+				},
+			},
+			Type: "action",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "FLASHBACK"},
+					},
+					Type: "scene-heading",
+				},
+			},
+			Type: "scene-heading",
+			Scene: &Scene{Location: "FLASHBACK"},
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "Bob was there."},
+					},
+					Type: "action",
+				},
+			},
+			Type: "action",
+		},
+	})
+}
+
+func TestDocSceneNumber(t *testing.T) {
+	script := `Title: The One Day
+
+.FLASHBACK - NIGHT #12A#
+
+EXT. GARDEN - DAY #13#
+
+INT. APARTMENT #5 - DAY`
+	doc := Parse(script)
+
+	expected := []Scene{
+		Scene{Location: "FLASHBACK", TimeOfDay: "NIGHT", Number: "12A"},
+		Scene{Exterior: true, Location: "GARDEN", TimeOfDay: "DAY", Number: "13"},
+		Scene{Interior: true, Location: "APARTMENT #5", TimeOfDay: "DAY"},
+	}
+	if len(doc.Body) != len(expected) {
+		t.Fatalf("Body is not %d scene headings, but is %v", len(expected), doc.Body)
+	}
+	for i, scene := range expected {
+		paragraph := doc.Body[i]
+		if !paragraph.IsSceneHeading() {
+			t.Errorf("Paragraph %d is not a scene heading, but is '%s'", i, paragraph.Type)
+			continue
+		}
+		if *paragraph.Scene != scene {
+			t.Errorf("Scene %d is not %v, but is %v", i, scene, *paragraph.Scene)
+		}
+	}
+
+	heading := doc.Body[0].Lines[0].Chunks[0].Content
+	if heading != "FLASHBACK - NIGHT" {
+		t.Errorf("Heading is not '%s', but is '%s'", "FLASHBACK - NIGHT", heading)
+	}
+}
+
+func TestDocTransition(t *testing.T) {
+	script := `Title: The One Day
+
+BOY
+Goodbye.
+
+CUT TO:
+
+The GIRL waves.
+
+>Fade to black.
+`
+	assertBody(t, script, []Paragraph{
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "BOY"},
+					},
+					Type: "speaker",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "Goodbye."},
+					},
+					Type: "dialogue",
+				},
+			},
+			Type: "dialogue",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "CUT TO:"},
+					},
+					Type: "transition",
+				},
+			},
+			Type: "transition",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "The GIRL waves."},
+					},
+					Type: "action",
+				},
+			},
+			Type: "action",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "Fade to black."},
+					},
+					Type: "transition",
+				},
+			},
+			Type: "transition",
+		},
+	})
+}
+
+func TestDocCentered(t *testing.T) {
+	script := `Title: The One Day
+
+The sun sets.
+> THE **END** <
+>Or is it?<`
+	assertBody(t, script, []Paragraph{
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "The sun sets."},
+					},
+					Type: "action",
+				},
+			},
+			Type: "action",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "THE "},
+						Chunk{Content: "END", Styles: []string{"bold"}},
+						Chunk{Content: ""},
+					},
+					Type: "centered",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "Or is it?"},
+					},
+					Type: "centered",
+				},
+			},
+			Type: "centered",
+		},
+	})
+}
+
+func TestDocStyledTransition(t *testing.T) {
+	script := `Title: The One Day
+
+> CUT TO *BLACK*:
+
+>SMASH CUT TO: [[fix]]
+
+> A <B> C`
+	assertBody(t, script, []Paragraph{
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "CUT TO "},
+						Chunk{Content: "BLACK", Styles: []string{"italic"}},
+						Chunk{Content: ":"},
+					},
+					Type: "transition",
+				},
+			},
+			Type: "transition",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "SMASH CUT TO: "},
+						Chunk{Content: "fix", Styles: []string{"comment"}},
+						Chunk{Content: ""},
+					},
+					Type: "transition",
+				},
+			},
+			Type: "transition",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "A <B> C"},
+					},
+					Type: "transition",
+				},
+			},
+			Type: "transition",
+		},
+	})
+}
+
+func TestDocPageBreak(t *testing.T) {
+	script := `Title: The One Day
+
+The BOY sleeps.
+
+=====
+
+The BOY wakes.`
+	assertBody(t, script, []Paragraph{
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "The BOY sleeps."},
+					},
+					Type: "action",
+				},
+			},
+			Type: "action",
+		},
+		Paragraph{
+			Lines: []Line{},
+			Type: "page-break",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "The BOY wakes."},
+					},
+					Type: "action",
+				},
+			},
+			Type: "action",
+		},
+	})
+
+	doc := Parse(script)
+	if !doc.Body[1].IsPageBreak() {
+		t.Errorf("Paragraph 1 is not a page break, but is '%s'", doc.Body[1].Type)
+	}
+
+	doc = Parse("The BOY sleeps.\n===\nThe BOY wakes.")
+	types := []string{}
+	for _, paragraph := range doc.Body {
+		types = append(types, paragraph.Type)
+	}
+	if strings.Join(types, " ") != "action page-break action" {
+		t.Errorf("Paragraphs are not action, page-break and action, but are %v", types)
+	}
+}
+
+func TestDocOutline(t *testing.T) {
+	script := `Title: The One Day
+
+# Act One
+
+= The BOY has a day.
+
+## Morning
+
+INT. BEDROOM - DAY
+
+The BOY wakes.
+
+## Evening
+
+EXT. GARDEN - NIGHT
+
+# Act Two
+
+INT. KITCHEN - DAY`
+	outline := Parse(script).Outline()
+
+	if outline.Title != "The One Day" || len(outline.Sections) != 2 {
+		t.Fatalf("Outline root is wrong: %v", outline)
+	}
+
+	actOne := outline.Sections[0]
+	if actOne.Title != "Act One" || actOne.Depth != 1 {
+		t.Errorf("Section is not 'Act One' at depth 1, but is '%s' at depth %d", actOne.Title, actOne.Depth)
+	}
+	if len(actOne.Synopses) != 1 || actOne.Synopses[0] != "The BOY has a day." {
+		t.Errorf("Synopses are wrong: %v", actOne.Synopses)
+	}
+	if len(actOne.Sections) != 2 || actOne.Sections[0].Title != "Morning" || actOne.Sections[1].Title != "Evening" {
+		t.Fatalf("Subsections are wrong: %v", actOne.Sections)
+	}
+
+	morning := actOne.Sections[0]
+	if len(morning.Scenes) != 1 || morning.Scenes[0].Scene.Location != "BEDROOM" {
+		t.Errorf("Scenes in 'Morning' are wrong: %v", morning.Scenes)
+	}
+
+	actTwo := outline.Sections[1]
+	if actTwo.Title != "Act Two" || len(actTwo.Sections) != 0 || len(actTwo.Scenes) != 1 {
+		t.Errorf("Section 'Act Two' is wrong: %v", actTwo)
+	}
+}
+
+func TestDocBoneyard(t *testing.T) {
+	script := `Title: The One Day
+
+The BOY runs.
+
+/*
+GHOST
+Boo!
+*/
+
+BOY
+I /* never */ saw a ghost.`
+	assertBody(t, script, []Paragraph{
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "The BOY runs."},
+					},
+					Type: "action",
+				},
+			},
+			Type: "action",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "BOY"},
+					},
+					Type: "speaker",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "I "},
+						Chunk{Content: " saw a ghost."},
+					},
+					Type: "dialogue",
+				},
+			},
+			Type: "dialogue",
+		},
+	})
+
+	expected := []Boneyard{
+		Boneyard{Content: "\nGHOST\nBoo!\n", Paragraph: 1},
+		Boneyard{Content: " never ", Paragraph: 1},
+	}
+	boneyard := Parse(script).Boneyard()
+	if len(boneyard) != len(expected) {
+		t.Fatalf("Boneyard is not %v, but is %v", expected, boneyard)
+	}
+	for i, cut := range expected {
+		if boneyard[i] != cut {
+			t.Errorf("Boneyard %d is not %v, but is %v", i, cut, boneyard[i])
+		}
+	}
+}
+
+func TestDocNotes(t *testing.T) {
+	script := `Title: The One Day
+
+The BOY runs. [[Too fast?
+
+Maybe.]]
+
+BOY
+Wait!
+(beat)
+Wait for me! [[Louder?]]`
+	assertBody(t, script, []Paragraph{
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "The BOY runs. "},
+						Chunk{Content: "Too fast?\n\nMaybe.", Styles: []string{"comment"}},
+						Chunk{Content: ""},
+					},
+					Type: "action",
+				},
+			},
+			Type: "action",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "BOY"},
+					},
+					Type: "speaker",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "Wait!"},
+					},
+					Type: "dialogue",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "beat"},
+					},
+					Type: "parenthetical",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "Wait for me! "},
+						Chunk{Content: "Louder?", Styles: []string{"comment"}},
+						Chunk{Content: ""},
+					},
+					Type: "dialogue",
+				},
+			},
+			Type: "dialogue",
+		},
+	})
+
+	expected := []Note{
+		Note{Content: "Too fast?\n\nMaybe.", Paragraph: 0, Line: 0},
+		Note{Content: "Louder?", Paragraph: 1, Line: 3},
+	}
+	notes := Parse(script).Notes()
+	if len(notes) != len(expected) {
+		t.Fatalf("Notes are not %v, but are %v", expected, notes)
+	}
+	for i, note := range expected {
+		if notes[i] != note {
+			t.Errorf("Note %d is not %v, but is %v", i, note, notes[i])
+		}
+	}
+}
+
+func TestDocNotesInHeadings(t *testing.T) {
+	script := `# Act One [[rename]]
+
+= He leaves. [[why?]]
+
+INT. HOUSE - DAY [[check]]
+
+> CUT TO: [[fix]]`
+	doc := Parse(script)
+
+	heading := doc.Body[2]
+	if heading.Scene.Location != "HOUSE" || heading.Scene.TimeOfDay != "DAY" {
+		t.Errorf("Scene is not HOUSE at DAY, but is %s at %s", heading.Scene.Location, heading.Scene.TimeOfDay)
+	}
+	if heading.Lines[0].Chunks[0].Content != "INT. HOUSE - DAY" {
+		t.Errorf("Heading is not '%s', but is '%s'", "INT. HOUSE - DAY", heading.Lines[0].Chunks[0].Content)
+	}
+
+	outline := doc.Outline()
+	if outline.Sections[0].Title != "Act One" || outline.Sections[0].Synopses[0] != "He leaves." {
+		t.Errorf("Section is not 'Act One' with synopsis 'He leaves.', but is '%s' with %q", outline.Sections[0].Title, outline.Sections[0].Synopses)
+	}
+
+	expected := []Note{
+		Note{Content: "rename", Paragraph: 0},
+		Note{Content: "why?", Paragraph: 1},
+		Note{Content: "check", Paragraph: 2},
+		Note{Content: "fix", Paragraph: 3},
+	}
+	notes := doc.Notes()
+	if len(notes) != len(expected) {
+		t.Fatalf("Notes are not %v, but are %v", expected, notes)
+	}
+	for i, note := range expected {
+		if notes[i] != note {
+			t.Errorf("Note %d is not %v, but is %v", i, note, notes[i])
+		}
+	}
+}
+
+func TestDocUnclosedNotesInHeadings(t *testing.T) {
+	for _, script := range []string{"= syn [[x", "# Act [[x", "INT. HOUSE [[x"} {
+		doc := Parse(script)
+
+		expected := []Note{Note{Content: "x", Paragraph: 0}}
+		notes := doc.Notes()
+		if len(notes) != len(expected) || notes[0] != expected[0] {
+			t.Errorf("Notes of %q are not %v, but are %v", script, expected, notes)
+		}
+		if chunks := doc.Body[0].Lines[0].Chunks; len(chunks) != 2 {
+			t.Errorf("Chunks of %q are not text and one note, but are %v", script, chunks)
+		}
+	}
+}
+
+func TestDocDualDialogue(t *testing.T) {
+	script := `Title: The One Day
+
+BOY
+Heads!
+
+GIRL ^
+Tails! [[Too loud?]]
+
+The coin lands.`
+	doc := Parse(script)
+
+	if len(doc.Body) != 2 {
+		t.Fatalf("Body is not 2 paragraphs, but is %v", doc.Body)
+	}
+
+	dual := doc.Body[0]
+	if !dual.IsDualDialogue() || len(dual.Columns) != 2 {
+		t.Fatalf("Paragraph is not dual dialogue, but is %v", dual)
+	}
+
+	left, right := dual.Columns[0], dual.Columns[1]
+	if left.Speaker() != "BOY" || strings.TrimSpace(left.Dialogue()) != "Heads!" {
+		t.Errorf("Left side is not BOY saying 'Heads!', but is %s saying '%s'", left.Speaker(), left.Dialogue())
+	}
+	if right.Speaker() != "GIRL" || strings.TrimSpace(right.Dialogue()) != "Tails!" {
+		t.Errorf("Right side is not GIRL saying 'Tails!', but is %s saying '%s'", right.Speaker(), right.Dialogue())
+	}
+
+	notes := doc.Notes()
+	expected := Note{Content: "Too loud?", Paragraph: 0, Column: 1, Line: 1}
+	if len(notes) != 1 || notes[0] != expected {
+		t.Errorf("Notes are not %v, but are %v", []Note{expected}, notes)
+	}
+}
+
+func TestDocDualDialogueBoneyard(t *testing.T) {
+	doc := Parse("BOB\nHi.\n\nMARY ^\nHey. /* cut */ there\n\nHe runs.")
+	expected := Boneyard{Content: " cut ", Paragraph: 0}
+	boneyard := doc.Boneyard()
+	if len(boneyard) != 1 || boneyard[0] != expected {
+		t.Errorf("Boneyard is not %v, but is %v", []Boneyard{expected}, boneyard)
+	}
+
+	dual := doc.Body[0]
+	if dual.IsDialogue() || dual.Speaker() != "" {
+		t.Errorf("Dual dialogue is dialogue spoken by '%s'", dual.Speaker())
+	}
+	if dual.Columns[0].Speaker() != "BOB" || dual.Columns[1].Speaker() != "MARY" {
+		t.Errorf("Columns are not spoken by BOB and MARY, but by '%s' and '%s'", dual.Columns[0].Speaker(), dual.Columns[1].Speaker())
+	}
+}
+
+func TestDocSpeakerExtensions(t *testing.T) {
+	script := `Title: The One Day
+
+BOY (V.O.) (CONT'D)
+I was there.
+
+BOY
+I still am.`
+	assertBody(t, script, []Paragraph{
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "BOY"},
+						Chunk{Content: "V.O.", Styles: []string{"extension"}},
+						Chunk{Content: "CONT'D", Styles: []string{"extension"}},
+					},
+					Type: "speaker",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "I was there."},
+					},
+					Type: "dialogue",
+				},
+			},
+			Type: "dialogue",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "BOY"},
+					},
+					Type: "speaker",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "I still am."},
+					},
+					Type: "dialogue",
+				},
+			},
+			Type: "dialogue",
+		},
+	})
+
+	doc := Parse(script)
+	if doc.Body[0].Speaker() != doc.Body[1].Speaker() {
+		t.Errorf("Speakers differ: '%s' and '%s'", doc.Body[0].Speaker(), doc.Body[1].Speaker())
+	}
+	extensions := doc.Body[0].Extensions()
+	if len(extensions) != 2 || extensions[0] != "V.O." || extensions[1] != "CONT'D" {
+		t.Errorf("Extensions are not [V.O. CONT'D], but are %v", extensions)
+	}
+}
+
+func TestDocForcedSpeakerAndAction(t *testing.T) {
+	script := `Title: The One Day
+
+@McCLANE (O.S.)
+Yippee ki-yay.
+
+!BOOM!`
+	assertBody(t, script, []Paragraph{
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "McCLANE"},
+						Chunk{Content: "O.S.", Styles: []string{"extension"}},
+					},
+					Type: "speaker",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "Yippee ki-yay."},
+					},
+					Type: "dialogue",
+				},
+			},
+			Type: "dialogue",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "BOOM!"},
+					},
+					Type: "action",
+				},
+			},
+			Type: "action",
+		},
+	})
+}
+
+func TestDocLyric(t *testing.T) {
+	script := `Title: The Musical
+
+~Willy Wonka! *Willy Wonka!*
+~The amazing chocolatier!
+He bows.`
+	assertBody(t, script, []Paragraph{
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "Willy Wonka! ", Styles: []string{}},
+						Chunk{Content: "Willy Wonka!", Styles: []string{"italic"}},
+						Chunk{Content: "", Styles: []string{}},
+					},
+					Type: "lyric",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "The amazing chocolatier!", Styles: []string{}},
+					},
+					Type: "lyric",
+				},
+			},
+			Type: "lyric",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "He bows.", Styles: []string{}},
+					},
+					Type: "action",
+				},
+			},
+			Type: "action",
+		},
+	})
+}
+
+func TestDocLyricInDialogue(t *testing.T) {
+	script := `BOB
+~Happy birthday
+to you.`
+	assertBody(t, script, []Paragraph{
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "BOB"},
+					},
+					Type: "speaker",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "Happy birthday"},
+					},
+					Type: "lyric",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "to you."},
+					},
+					Type: "dialogue",
+				},
+			},
+			Type: "dialogue",
+		},
+	})
+}
+
+func TestDocEscapes(t *testing.T) {
+	script := `Title: The One Day
+
+He types \_\_init\_\_ and \[[not a note\]].`
+	doc := Parse(script)
+
+	expected := "He types __init__ and [[not a note]]."
+	if doc.Body[0].Text() != expected {
+		t.Errorf("Text is not '%s', but is '%s'", expected, doc.Body[0].Text())
+	}
+	for _, chunk := range doc.Body[0].Lines[0].Chunks {
+		if len(chunk.Styles) > 0 {
+			t.Errorf("Chunk '%s' is styled %v", chunk.Content, chunk.Styles)
+		}
+	}
+	if len(doc.Notes()) != 0 {
+		t.Errorf("Notes are not empty, but are %v", doc.Notes())
+	}
+}
+
+func TestDocEscapesInHeadings(t *testing.T) {
+	script := `Title: The One Day
+
+INT. HOUSE \#1# - DAY
+
+INT. HOUSE \[[x
+
+= Not \[[a note`
+	doc := Parse(script)
+
+	expected := Scene{Interior: true, Location: "HOUSE #1#", TimeOfDay: "DAY"}
+	if *doc.Body[0].Scene != expected {
+		t.Errorf("Scene is not %v, but is %v", expected, *doc.Body[0].Scene)
+	}
+	if doc.Body[1].Scene.Location != "HOUSE [[x" {
+		t.Errorf("Location is not '%s', but is '%s'", "HOUSE [[x", doc.Body[1].Scene.Location)
+	}
+	if doc.Body[2].Text() != "Not [[a note" {
+		t.Errorf("Synopsis is not '%s', but is '%s'", "Not [[a note", doc.Body[2].Text())
+	}
+	if len(doc.Notes()) != 0 {
+		t.Errorf("Notes are not empty, but are %v", doc.Notes())
+	}
+	if _, diagnostics, _ := ParseDiagnostics(script); len(diagnostics) != 0 {
+		t.Errorf("Diagnostics are not empty, but are %v", diagnostics)
+	}
+}
+
+func TestDocUnicodeCues(t *testing.T) {
+	script := `Title: The One Day
+
+ÉLODIE (V.O.)
+Ça va?
+
+Élodie entre.`
+	doc := Parse(script)
+
+	if len(doc.Body) != 2 {
+		t.Fatalf("Body does not have %d paragraphs, but has %d", 2, len(doc.Body))
+	}
+	if doc.Body[0].Speaker() != "ÉLODIE" {
+		t.Errorf("Speaker is not '%s', but is '%s'", "ÉLODIE", doc.Body[0].Speaker())
+	}
+	if doc.Body[1].Type != "action" {
+		t.Errorf("Paragraph is not action, but is '%s'", doc.Body[1].Type)
+	}
+}
+
+func TestDocShortLineBeforeWideRune(t *testing.T) {
+	for _, script := range []string{"?\n你好", "OK\n😀", "He runs.\n\nA\n你好"} {
+		doc := Parse(script)
+		for _, paragraph := range doc.Body {
+			for _, line := range paragraph.Lines {
+				for _, chunk := range line.Chunks {
+					span := script[chunk.Span.Start.Offset:chunk.Span.End.Offset]
+					if span != chunk.Content || strings.Contains(span, "\n") {
+						t.Errorf("Chunk '%s' of %q does not span its own text, but spans '%s'", chunk.Content, script, span)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDocCapitalizedAction(t *testing.T) {
+	script := `Title: The One Day
+
+BANG!
+
+BOB
+Get down!`
+	doc := Parse(script)
+
+	if len(doc.Body) != 2 {
+		t.Fatalf("Body does not have %d paragraphs, but has %d", 2, len(doc.Body))
+	}
+	if doc.Body[0].Type != "action" || doc.Body[0].Text() != "BANG!" {
+		t.Errorf("First paragraph is not action 'BANG!', but is %s '%s'", doc.Body[0].Type, doc.Body[0].Text())
+	}
+	if doc.Body[1].Speaker() != "BOB" {
+		t.Errorf("Speaker is not '%s', but is '%s'", "BOB", doc.Body[1].Speaker())
+	}
+}
+
+func TestDocNoTitlePage(t *testing.T) {
+	script := `
+INT. HOUSE - DAY
+
+BOB
+Anyone home?`
+	doc := Parse(script)
+
+	if doc.Title != "" || len(doc.TitlePage) != 0 {
+		t.Errorf("Title page is not empty, but is %v", doc.TitlePage)
+	}
+	if len(doc.Body) != 2 {
+		t.Fatalf("Body does not have %d paragraphs, but has %d", 2, len(doc.Body))
+	}
+	if !doc.Body[0].IsSceneHeading() {
+		t.Errorf("First paragraph is not a scene heading, but is '%s'", doc.Body[0].Type)
+	}
+	if doc.Body[1].Speaker() != "BOB" {
+		t.Errorf("Speaker is not '%s', but is '%s'", "BOB", doc.Body[1].Speaker())
+	}
+}
+
+func TestDocLineEndings(t *testing.T) {
+	unix := Parse("Title: The One Day\n\nBOB\nHello.\n\nA CROWD gathers.\n")
+	windows := Parse("\ufeffTitle: The One Day\r\n\r\nBOB\r\nHello.\r\n\r\nA CROWD gathers.\r\n")
+
+	if windows.Title != unix.Title {
+		t.Errorf("Title is not '%s', but is '%s'", unix.Title, windows.Title)
+	}
+	if len(windows.Body) != len(unix.Body) {
+		t.Fatalf("Body does not have %d paragraphs, but has %d", len(unix.Body), len(windows.Body))
+	}
+	for i := range unix.Body {
+		if windows.Body[i].Text() != unix.Body[i].Text() {
+			t.Errorf("Paragraph is not '%s', but is '%s'", unix.Body[i].Text(), windows.Body[i].Text())
+		}
+	}
+}
+
+func TestDocTwoSpaceLines(t *testing.T) {
+	script := "Title: The One Day\n\nBOB\nFirst verse.\n  \nSecond verse.\n\nHe waits.\n  \nAnd waits."
+	assertBody(t, script, []Paragraph{
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "BOB"},
+					},
+					Type: "speaker",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "First verse."},
+					},
+					Type: "dialogue",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: ""},
+					},
+					Type: "dialogue",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "Second verse."},
+					},
+					Type: "dialogue",
+				},
+			},
+			Type: "dialogue",
+		},
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "He waits.", Styles: []string{}},
+					},
+					Type: "action",
+				},
+				Line{
+					Chunks: []Chunk{},
+					Type: "action",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "And waits.", Styles: []string{}},
+					},
+					Type: "action",
+				},
+			},
+			Type: "action",
+		},
+	})
+}
+
+func TestDocUnmatchedEmphasis(t *testing.T) {
+	script := `Title: The One Day
+
+He writes 5 * 3 in *chalk* and saves my_file.txt.
+_Underlined_ and **bold** stay styled.`
+	assertBody(t, script, []Paragraph{
+		Paragraph{
+			Lines: []Line{
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "He writes 5 * 3 in ", Styles: []string{}},
+						Chunk{Content: "chalk", Styles: []string{"italic"}},
+						Chunk{Content: " and saves my_file.txt.", Styles: []string{}},
+					},
+					Type: "action",
+				},
+				Line{
+					Chunks: []Chunk{
+						Chunk{Content: "", Styles: []string{}},
+						Chunk{Content: "Underlined", Styles: []string{"underline"}},
+						Chunk{Content: " and ", Styles: []string{}},
+						Chunk{Content: "bold", Styles: []string{"bold"}},
+						Chunk{Content: " stay styled.", Styles: []string{}},
+					},
+					Type: "action",
+				},
+			},
+			Type: "action",
+		},
+	})
+}
+
+func TestDocEmphasisEndsWithLine(t *testing.T) {
+	script := `Title: The One Day
+
+BOB
+*Wait.
+Stop*`
+	doc := Parse(script)
+
+	for _, line := range doc.Body[0].Lines {
+		for _, chunk := range line.Chunks {
+			if len(chunk.Styles) > 0 {
+				t.Errorf("Chunk '%s' is styled %v", chunk.Content, chunk.Styles)
+			}
+		}
+	}
+	if strings.TrimSpace(doc.Body[0].Dialogue()) != "*Wait. Stop*" {
+		t.Errorf("Dialogue is not '%s', but is '%s'", "*Wait. Stop*", strings.TrimSpace(doc.Body[0].Dialogue()))
+	}
+}
+
+func TestDocElements(t *testing.T) {
+	script := `Title: The One Day
+
+INT. HOUSE - DAY
+
+BOB (V.O.)
+*Hello* there.`
+	doc := Parse(script)
+
+	types := []ElementType{}
+	for i := range doc.Body {
+		var block Block = &doc.Body[i]
+		types = append(types, block.Element())
+	}
+	if len(types) != 2 || types[0] != ElementSceneHeading || types[1] != ElementDialogue {
+		t.Errorf("Elements are not %v, but are %v", []ElementType{ElementSceneHeading, ElementDialogue}, types)
+	}
+
+	lines := doc.Body[1].Children()
+	speaker := lines[0].(*Line)
+	if speaker.Element() != ElementSpeaker {
+		t.Errorf("Line is not '%s', but is '%s'", ElementSpeaker, speaker.Element())
+	}
+	if !speaker.Chunks[1].Style().Has(StyleExtension) {
+		t.Errorf("Chunk '%s' is not an extension", speaker.Chunks[1].Content)
+	}
+
+	var hello Inline
+	for _, child := range lines[1].(*Line).Children() {
+		if inline := child.(Inline); inline.Text() == "Hello" {
+			hello = inline
+		}
+	}
+	if hello == nil {
+		t.Errorf("Line has no chunk '%s'", "Hello")
+	} else if hello.Style() != StyleItalic {
+		t.Errorf("Chunk '%s' is not only italic, but is %v", hello.Text(), hello.Style())
+	}
+
+	if ParseElementType("dual-dialogue") != ElementDualDialogue || ElementDualDialogue.String() != "dual-dialogue" {
+		t.Errorf("Element type does not round trip through '%s'", "dual-dialogue")
+	}
+}
+
+func TestDocSpans(t *testing.T) {
+	script := "\ufeffTitle: The One Day\r\n\r\nINT. HOUSE - DAY\r\n\r\nBOB (V.O.)\r\nHello *there*.\r\n"
+	doc := Parse(script)
+
+	at := func(span Span) string {
+		return script[span.Start.Offset:span.End.Offset]
+	}
+
+	heading := doc.Body[0]
+	if heading.Span.Start != (Position{Offset: 25, Line: 3, Column: 1}) {
+		t.Errorf("Heading does not start at %v, but at %v", Position{Offset: 25, Line: 3, Column: 1}, heading.Span.Start)
+	}
+	if at(heading.Span) != "INT. HOUSE - DAY" {
+		t.Errorf("Heading spans '%s'", at(heading.Span))
+	}
+
+	dialogue := doc.Body[1]
+	speaker := dialogue.Lines[0]
+	if at(speaker.Chunks[0].Span) != "BOB" || at(speaker.Chunks[1].Span) != "V.O." {
+		t.Errorf("Speaker spans '%s' and '%s'", at(speaker.Chunks[0].Span), at(speaker.Chunks[1].Span))
+	}
+
+	line := dialogue.Lines[1]
+	if line.Span.Start != (Position{Offset: 57, Line: 6, Column: 1}) {
+		t.Errorf("Dialogue does not start at %v, but at %v", Position{Offset: 57, Line: 6, Column: 1}, line.Span.Start)
+	}
+	if at(line.Chunks[1].Span) != "there" || line.Chunks[1].Span.Start.Column != 8 {
+		t.Errorf("Italic chunk spans '%s' from column %d", at(line.Chunks[1].Span), line.Chunks[1].Span.Start.Column)
+	}
+	if at(dialogue.Span) != "BOB (V.O.)\r\nHello *there*." {
+		t.Errorf("Dialogue spans '%s'", at(dialogue.Span))
+	}
+}
+
+func TestDocDiagnostics(t *testing.T) {
+	script := `Title: The One Day
+Contact:
+
+BOB ^
+Hello [[unfinished note.`
+	doc, diagnostics, err := ParseDiagnostics(script)
+
+	if doc == nil || len(doc.Body) == 0 {
+		t.Fatalf("Body is empty")
+	}
+	expected := []Diagnostic{
+		Diagnostic{SeverityWarning, `title page key "Contact" has no value`, Position{Offset: 19, Line: 2, Column: 1}},
+		Diagnostic{SeverityError, "note is not closed with ]]", Position{Offset: 41, Line: 5, Column: 7}},
+		Diagnostic{SeverityWarning, "dual dialogue has no dialogue before it", Position{Offset: 29, Line: 4, Column: 1}},
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("Diagnostics are not %v, but are %v", expected, diagnostics)
+	}
+	for i := range expected {
+		if diagnostics[i] != expected[i] {
+			t.Errorf("Diagnostic is not '%s', but is '%s'", expected[i], diagnostics[i])
+		}
+	}
+	if err != expected[1] {
+		t.Errorf("Error is not '%s', but is '%v'", expected[1], err)
+	}
+
+	_, diagnostics, err = ParseDiagnostics("Title: The One Day\n\nHe waits. /* cut")
+	if err == nil || err.Error() != "3:11: error: boneyard is not closed with */" {
+		t.Errorf("Error is not '%s', but is '%v'", "3:11: error: boneyard is not closed with */", err)
+	}
+
+	_, diagnostics, err = ParseDiagnostics("Title: The One Day\n\nHe waits.")
+	if len(diagnostics) != 0 || err != nil {
+		t.Errorf("Diagnostics are not empty, but are %v", diagnostics)
+	}
+}
+
+func TestDocUnclosedBoneyard(t *testing.T) {
+	_, diagnostics, err := ParseDiagnostics("/*")
+	expected := Diagnostic{SeverityError, "boneyard is not closed with */", Position{Offset: 0, Line: 1, Column: 1}}
+	if len(diagnostics) != 1 || err != expected {
+		t.Errorf("Diagnostics are not %v, but are %v", []Diagnostic{expected}, diagnostics)
+	}
+
+	_, diagnostics, err = ParseDiagnostics("~/**/V.O.\\")
+	if err != nil {
+		t.Errorf("Error is not nil, but is '%v'", err)
+	}
+
+	_, diagnostics, err = ParseDiagnostics("He waits. /**/ ok")
+	if len(diagnostics) != 0 || err != nil {
+		t.Errorf("Diagnostics are not empty, but are %v", diagnostics)
+	}
+}
+
+func TestDocEach(t *testing.T) {
+	script := `Title: The One Day
+
+INT. HOUSE - DAY
+
+BOB
+Hello?
+
+ALICE ^
+Hello! [[Too loud?]]
+
+They laugh.`
+	types := []string{}
+	doc, err := Each(strings.NewReader(script), func(paragraph Paragraph) error {
+		types = append(types, paragraph.Type)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Error is not nil, but is '%s'", err)
+	}
+	if doc.Title != "The One Day" {
+		t.Errorf("Title is not '%s', but is '%s'", "The One Day", doc.Title)
+	}
+	if len(doc.Body) != 0 {
+		t.Errorf("Body is not empty, but is %v", doc.Body)
+	}
+	if strings.Join(types, ",") != "scene-heading,dual-dialogue,action" {
+		t.Errorf("Paragraphs are not '%s', but are '%s'", "scene-heading,dual-dialogue,action", strings.Join(types, ","))
+	}
+	if len(doc.Notes()) != 1 || doc.Notes()[0].Paragraph != 1 || doc.Notes()[0].Column != 1 {
+		t.Errorf("Notes are not anchored to the dual dialogue, but are %v", doc.Notes())
+	}
+
+	stop := errors.New("stop")
+	count := 0
+	_, err = Each(strings.NewReader(script), func(paragraph Paragraph) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Errorf("Each did not stop after the first paragraph, but read %d and returned '%v'", count, err)
+	}
+
+	doc, diagnostics, err := ParseReader(strings.NewReader(script))
+	if err != nil || len(diagnostics) != 0 || len(doc.Body) != 3 {
+		t.Errorf("ParseReader did not parse %d paragraphs, but parsed %d and returned '%v'", 3, len(doc.Body), err)
+	}
+
+	_, diagnostics, err = ParseReader(strings.NewReader("He waits. [[cut"))
+	expected := Diagnostic{SeverityError, "note is not closed with ]]", Position{Offset: 10, Line: 1, Column: 11}}
+	if len(diagnostics) != 1 || err != expected {
+		t.Errorf("Error is not '%s', but is '%v'", expected, err)
+	}
+
+	_, err = Each(strings.NewReader("He waits. [[cut"), func(paragraph Paragraph) error {
+		return nil
+	})
+	if err != expected {
+		t.Errorf("Error is not '%s', but is '%v'", expected, err)
+	}
+}
+
+func TestDocContext(t *testing.T) {
+	script := strings.Repeat("INT. HOUSE - DAY\n\nBOB\nHello?\n\n", 100)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	doc, _, err := ParseContext(ctx, script)
+	if err != context.Canceled || len(doc.Body) != 0 {
+		t.Errorf("Error is not '%s', but is '%v'", context.Canceled, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	count := 0
+	_, err = EachContext(ctx, strings.NewReader(script), func(paragraph Paragraph) error {
+		count++
+		if count == 3 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled || count >= 200 {
+		t.Errorf("EachContext did not stop when canceled, but read %d and returned '%v'", count, err)
+	}
+}
+
+func TestDocActionAfterDialogue(t *testing.T) {
+	doc := Parse("BOB\n(beat)\n\nHe runs away.\n\nMARY\nHi.")
+	types := []string{}
+	for _, paragraph := range doc.Body {
+		types = append(types, paragraph.Type)
+	}
+	if strings.Join(types, ",") != "dialogue,action,dialogue" {
+		t.Errorf("Paragraphs are not '%s', but are '%s'", "dialogue,action,dialogue", strings.Join(types, ","))
+	}
+
+	doc = Parse("@McCLANE\n\nHe runs away.")
+	if len(doc.Body) != 2 || doc.Body[1].Text() != "He runs away." {
+		t.Errorf("Action after a forced cue is not '%s', but body is %v", "He runs away.", doc.Body)
+	}
+}
+
+func TestDocSpansOfShortTokens(t *testing.T) {
+	script := "\r\n\r\n!!\r\n\r\nHe waits. /**/ ok"
+	doc := Parse(script)
+
+	at := func(span Span) string {
+		return script[span.Start.Offset:span.End.Offset]
+	}
+
+	chunk := doc.Body[0].Lines[0].Chunks[0]
+	if chunk.Span.Start != (Position{Offset: 5, Line: 3, Column: 2}) || at(chunk.Span) != "!" {
+		t.Errorf("Chunk '%s' does not span '!' from %v, but spans '%s' from %v", chunk.Content, Position{Offset: 5, Line: 3, Column: 2}, at(chunk.Span), chunk.Span.Start)
+	}
+
+	line := doc.Body[1].Lines[0]
+	if at(line.Span) != "He waits. /**/ ok" {
+		t.Errorf("Line spans '%s'", at(line.Span))
+	}
+}
+
+func TestDocSpansOfNotedText(t *testing.T) {
+	for _, script := range []string{"=\t", "#\t", "= [[n]] syn ", "# Act [[n]]\t", "INT. HOUSE  [[n]] #1#"} {
+		doc := Parse(script)
+		chunk := doc.Body[0].Lines[0].Chunks[0]
+		if chunk.Span.End.Offset < chunk.Span.Start.Offset {
+			t.Errorf("Chunk '%s' of %q ends at %d before it starts at %d", chunk.Content, script, chunk.Span.End.Offset, chunk.Span.Start.Offset)
+			continue
+		}
+		span := script[chunk.Span.Start.Offset:chunk.Span.End.Offset]
+		if strings.Trim(span, " \t") != span {
+			t.Errorf("Chunk '%s' of %q spans untrimmed '%s'", chunk.Content, script, span)
+		}
+		if !strings.HasPrefix(span, chunk.Content) || !strings.HasSuffix(span, chunk.Content[strings.LastIndex(chunk.Content, " ")+1:]) {
+			t.Errorf("Chunk '%s' of %q spans '%s'", chunk.Content, script, span)
+		}
+	}
+}
+
+func TestDocSpansLeaveOutMarkup(t *testing.T) {
+	script := "# Act 1\n\n.FLASHBACK #12A#\n\n@McCLANE\nYippee.\n\n~Ki-yay"
+	doc := Parse(script)
+
+	at := func(span Span) string {
+		return script[span.Start.Offset:span.End.Offset]
+	}
+
+	expected := []string{"Act 1", "FLASHBACK", "McCLANE\nYippee.", "Ki-yay"}
+	if len(doc.Body) != len(expected) {
+		t.Fatalf("Body is not %d paragraphs, but is %v", len(expected), doc.Body)
+	}
+	for i, span := range expected {
+		if at(doc.Body[i].Span) != span {
+			t.Errorf("Paragraph %d does not span '%s', but spans '%s'", i, span, at(doc.Body[i].Span))
+		}
+	}
+}
+
+func TestSourceAllocations(t *testing.T) {
+	script := strings.Repeat("INT. HOUSE - DAY\n\nBOB\nHello?\n\n", 20000)
+	allocs := testing.AllocsPerRun(5, func() {
+		newSource(script)
+	})
+	if allocs > 64 {
+		t.Errorf("Cleaning up a script with no carriage returns took %v allocations", allocs)
+	}
+}
+
 func assertBody(t *testing.T, script string, expectedParagraphs []Paragraph) {
 	doc := Parse(script)
 
 	mismatch := func() {
 		t.Errorf(`Body wrong.
-Expected: %s
-Actual:   %s
+Expected: %v
+Actual:   %v
 Source:
 -------
 %s`, expectedParagraphs, doc.Body, script)
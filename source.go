@@ -0,0 +1,109 @@
+package fountain
+
+import (
+	"sort"
+	"strings"
+)
+
+// source is a script cleaned up for the lexer, with the means to find where
+// anything in it came from in the original.
+type source struct {
+	text string
+	// base is the offset in the original of the start of text, and
+	// baseLine the line it is on.
+	base, baseLine int
+	// shifts records each place in text after which the original has
+	// dropped more bytes, for the line endings that lost a carriage return.
+	shifts []shift
+	// lines holds the offset in text at which each line after the first
+	// starts.
+	lines []int
+}
+
+// shift says that from offset at in text, the original is ahead by by.
+type shift struct {
+	at, by int
+}
+
+// newSource drops a leading byte order mark and turns Windows and old Mac
+// line endings into newlines, which is all the lexer looks for. Blank lines
+// around the script carry no meaning either, and dropping trailing ones
+// means a newline is always followed by something nextLineBlank can back up
+// over.
+func newSource(src string) *source {
+	s := &source{baseLine: 1}
+	if strings.HasPrefix(src, "\ufeff") {
+		src = src[len("\ufeff"):]
+		s.base = len("\ufeff")
+	}
+
+	text := src
+	if strings.IndexByte(src, '\r') >= 0 {
+		b := make([]byte, 0, len(src))
+		for i := 0; i < len(src); i++ {
+			if src[i] != '\r' {
+				b = append(b, src[i])
+				continue
+			}
+			b = append(b, '\n')
+			if i+1 < len(src) && src[i+1] == '\n' {
+				i++
+				s.shifts = append(s.shifts, shift{at: len(b), by: i + 1 - len(b)})
+			}
+		}
+		text = string(b)
+	}
+
+	// Fold what comes before the first line of text into base.
+	lead := len(text) - len(strings.TrimLeft(text, "\n"))
+	ahead := s.original(lead) - s.base - lead
+	s.base += lead + ahead
+	s.baseLine += lead
+	shifts := []shift{}
+	for _, sh := range s.shifts {
+		if sh.at > lead {
+			shifts = append(shifts, shift{at: sh.at - lead, by: sh.by - ahead})
+		}
+	}
+	s.shifts = shifts
+	s.text = strings.Trim(text, "\n")
+
+	s.lines = make([]int, 0, strings.Count(s.text, "\n"))
+	for i := 0; i < len(s.text); i++ {
+		if s.text[i] == '\n' {
+			s.lines = append(s.lines, i+1)
+		}
+	}
+	return s
+}
+
+// original returns the offset in the original of offset i in text.
+func (s *source) original(i int) int {
+	j := sort.Search(len(s.shifts), func(j int) bool { return s.shifts[j].at > i })
+	if j == 0 {
+		return s.base + i
+	}
+	return s.base + i + s.shifts[j-1].by
+}
+
+// position returns the position in the original of offset i in text.
+func (s *source) position(i int) Position {
+	if i < 0 {
+		i = 0
+	}
+	if i > len(s.text) {
+		i = len(s.text)
+	}
+	line := sort.SearchInts(s.lines, i+1)
+	start := 0
+	if line > 0 {
+		start = s.lines[line-1]
+	}
+	offset := s.original(i)
+	return Position{Offset: offset, Line: s.baseLine + line, Column: offset - s.original(start) + 1}
+}
+
+// span returns the span in the original of text[start:end].
+func (s *source) span(start, end int) Span {
+	return Span{Start: s.position(start), End: s.position(end)}
+}